@@ -4,22 +4,30 @@
 package base
 
 import (
+	"bufio"
+	"crypto/hmac"
 	"crypto/sha1"
 	"database/sql"
 	"encoding/base64"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	"github.com/hexya-erp/hexya/src/actions"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
 	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/b64image"
 	"github.com/hexya-erp/hexya/src/tools/strutils"
 	"github.com/hexya-erp/pool/h"
 	"github.com/hexya-erp/pool/m"
@@ -55,6 +63,58 @@ var fields_Attachment = map[string]models.FieldDefinition{
 	"CheckSum":     fields.Char{String: "Checksum/SHA1", Size: 40, Index: true, ReadOnly: true},
 	"MimeType":     fields.Char{ReadOnly: true},
 	"IndexContent": fields.Text{String: "Indexed Content", ReadOnly: true},
+	"Thumbnail512": fields.Binary{String: "Thumbnail", JSON: "thumbnail_512", ReadOnly: true},
+	"Thumbnail256": fields.Binary{String: "Thumbnail", JSON: "thumbnail_256", ReadOnly: true},
+	"Thumbnail128": fields.Binary{String: "Thumbnail", JSON: "thumbnail_128", ReadOnly: true},
+	"Versioned": fields.Boolean{String: "Keep Versions",
+		Help: "If set, previous contents of this attachment are kept as versions when it is modified"},
+}
+
+var fields_AttachmentQuota = map[string]models.FieldDefinition{
+	"Company": fields.Many2One{RelationModel: h.Company(), OnDelete: models.Cascade, Index: true},
+	"User":    fields.Many2One{RelationModel: h.User(), OnDelete: models.Cascade, Index: true},
+	"Group": fields.Many2One{RelationModel: h.Group(), OnDelete: models.Cascade, Index: true,
+		Help: "The quota applies to each member of the group"},
+	"MaxTotalSize": fields.Integer{String: "Maximum Total Size",
+		Help: "Maximum total size in bytes of the attachments, including their versions. 0 means unlimited."},
+	"MaxFileSize": fields.Integer{String: "Maximum File Size",
+		Help: "Maximum size in bytes of a single attachment. 0 means unlimited."},
+}
+
+var fields_AttachmentUsageLine = map[string]models.FieldDefinition{
+	"Company":      fields.Many2One{RelationModel: h.Company()},
+	"ResModel":     fields.Char{String: "Resource Model"},
+	"User":         fields.Many2One{RelationModel: h.User()},
+	"Count":        fields.Integer{String: "Attachments"},
+	"TotalSize":    fields.Integer{String: "Total Size"},
+	"VersionsSize": fields.Integer{String: "Versions Size"},
+}
+
+var fields_AttachmentCheckLine = map[string]models.FieldDefinition{
+	"Issue": fields.Selection{Selection: types.Selection{
+		"missing":   "Missing Content",
+		"checksum":  "Checksum Mismatch",
+		"orphan":    "Orphan File",
+		"duplicate": "Duplicate Content",
+	}, Required: true},
+	"Attachment": fields.Many2One{RelationModel: h.Attachment(), OnDelete: models.Cascade},
+	"StoreFname": fields.Char{String: "Stored Filename"},
+	"CheckSum":   fields.Char{String: "Checksum/SHA1", Size: 40},
+	"Repaired":   fields.Boolean{},
+}
+
+var fields_AttachmentVersion = map[string]models.FieldDefinition{
+	"Attachment": fields.Many2One{RelationModel: h.Attachment(), Required: true, Index: true,
+		OnDelete: models.Cascade},
+	"Version":      fields.Integer{Required: true, ReadOnly: true},
+	"Author":       fields.Many2One{RelationModel: h.User(), ReadOnly: true},
+	"Date":         fields.DateTime{ReadOnly: true},
+	"DBDatas":      fields.Char{String: "Database Data"},
+	"StoreFname":   fields.Char{String: "Stored Filename"},
+	"FileSize":     fields.Integer{GoType: new(int), ReadOnly: true},
+	"CheckSum":     fields.Char{String: "Checksum/SHA1", Size: 40, Index: true, ReadOnly: true},
+	"MimeType":     fields.Char{ReadOnly: true},
+	"IndexContent": fields.Text{String: "Indexed Content", ReadOnly: true},
 }
 
 // ComputeResName computes the display name of the ressource this document is attached to.
@@ -72,26 +132,45 @@ func attachment_Storage(rs m.AttachmentSet) string {
 	return h.ConfigParameter().NewSet(rs.Env()).GetParam("attachment.location", "file")
 }
 
+// storageBackend returns the configured storage backend for new attachment contents.
+func storageBackend(rs m.AttachmentSet) AttachmentStorage {
+	storage, ok := GetAttachmentStorage(rs.Storage())
+	if !ok {
+		panic(rs.T("Unknown attachment storage: %s", rs.Storage()))
+	}
+	return storage
+}
+
+// CurrentStorage returns the name of the storage backend that holds the content of this
+// attachment, or an empty string if this attachment has no content.
+func attachment_CurrentStorage(rs m.AttachmentSet) string {
+	rs.EnsureOne()
+	return attachmentStorageName(rs.StoreFname(), rs.DBDatas())
+}
+
 // FileStore returns the directory in which the attachment files are saved.
 func attachment_FileStore(_ m.AttachmentSet) string {
 	return filepath.Join(viper.GetString("DataDir"), "filestore")
 }
 
-// ForceStorage forces all attachments to be stored in the currently configured storage
+// ForceStorage forces all attachments to be stored in the currently configured storage,
+// whatever the storage they are currently stored in.
 func attachment_ForceStorage(rs m.AttachmentSet) bool {
 	if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
 		log.Panic(rs.T("Only administrators can execute this action."))
 	}
-	var cond q.AttachmentCondition
-	switch rs.Storage() {
-	case "db":
-		cond = q.Attachment().StoreFname().IsNotNull()
-	case "file":
-		cond = q.Attachment().DBDatas().IsNotNull()
-	}
+	storage := rs.Storage()
+	storageBackend(rs)
+	cond := q.Attachment().StoreFname().IsNotNull().Or().DBDatas().IsNotNull()
+	var migrated int
 	for _, attach := range h.Attachment().Search(rs.Env(), cond).Records() {
+		if attach.CurrentStorage() == storage {
+			continue
+		}
 		attach.SetDatas(attach.Datas())
+		migrated++
 	}
+	log.Info("Attachments migrated", "storage", storage, "count", migrated)
 	return true
 }
 
@@ -116,14 +195,20 @@ func attachment_GetPath(rs m.AttachmentSet, sha string) (string, string) {
 func attachment_FileRead(rs m.AttachmentSet, fileName string, binSize bool) string {
 	fullPath := rs.FullPath(fileName)
 	if binSize {
-		fInfo, err := os.Stat(fullPath)
+		size, err := filestoreFileSize(fullPath)
 		if err != nil {
 			log.Warn("Error while stating file", "file", fullPath, "error", err)
 			return ""
 		}
-		return strutils.HumanSize(fInfo.Size())
+		return strutils.HumanSize(size)
 	}
-	data, err := ioutil.ReadFile(fullPath)
+	r, err := openFilestoreFile(fullPath)
+	if err != nil {
+		log.Warn("Unable to read file", "file", fullPath, "error", err)
+		return ""
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
 	if err != nil {
 		log.Warn("Unable to read file", "file", fullPath, "error", err)
 		return ""
@@ -135,20 +220,12 @@ func attachment_FileRead(rs m.AttachmentSet, fileName string, binSize bool) stri
 //
 // It returns the filename of the written file.`,
 func attachment_FileWrite(rs m.AttachmentSet, value, sha string) string {
-	fName, fullPath := rs.GetPath(sha)
-	_, err := os.Stat(fullPath)
-	if err == nil {
-		// File already exists
-		return fName
-	}
-	data, err := base64.StdEncoding.DecodeString(value)
+	r := base64.NewDecoder(base64.StdEncoding, strings.NewReader(value))
+	values, err := fileStorage{}.Write(rs, r, int64(base64.StdEncoding.DecodedLen(len(value))), sha)
 	if err != nil {
-		log.Warn("Unable to decode file content", "file", sha, "error", err)
+		log.Panic("Unable to write file", "file", sha, "error", err)
 	}
-	ioutil.WriteFile(fullPath, data, 0644)
-	// add fname to checklist, in case the transaction aborts
-	rs.MarkForGC(fName)
-	return fName
+	return values.StoreFname()
 }
 
 // FileDelete adds the given file name to the checklist for the garbage collector
@@ -157,6 +234,7 @@ func attachment_FileDelete(rs m.AttachmentSet, fName string) {
 }
 
 // MarkForGC adds fName in a checklist for filestore garbage collection.
+// fName is the StoreFname of an attachment, whatever its storage backend.
 func attachment_MarkForGC(rs m.AttachmentSet, fName string) {
 	// we use a spooldir: add an empty file in the subdirectory 'checklist'
 	fullPath := filepath.Join(rs.FullPath("checklist"), fName)
@@ -164,21 +242,30 @@ func attachment_MarkForGC(rs m.AttachmentSet, fName string) {
 	ioutil.WriteFile(fullPath, []byte{}, 0644)
 }
 
-// FileGC performs the garbage collection of the filestore.`,
+// FileGC performs the garbage collection of the filestore.
+//
+// Unreferenced contents are removed from the storage backend that holds them.`,
 func attachment_FileGC(rs m.AttachmentSet) {
-	if rs.Storage() != "file" {
-		return
-	}
 	rSet := h.Attachment().NewSet(rs.Env())
 
 	// retrieve the file names from the checklist
 	var checklist []string
-	err := filepath.Walk(rSet.FullPath("checklist"), func(path string, info os.FileInfo, err error) error {
+	checklistDir := rSet.FullPath("checklist")
+	if _, err := os.Stat(checklistDir); os.IsNotExist(err) {
+		return
+	}
+	err := filepath.Walk(checklistDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
 		if info.IsDir() {
 			return nil
 		}
-		fName := filepath.Join(filepath.Base(filepath.Dir(path)), info.Name())
-		checklist = append(checklist, fName)
+		fName, err := filepath.Rel(checklistDir, path)
+		if err != nil {
+			return err
+		}
+		checklist = append(checklist, filepath.ToSlash(fName))
 		return nil
 	})
 	if err != nil {
@@ -186,8 +273,14 @@ func attachment_FileGC(rs m.AttachmentSet) {
 	}
 
 	// determine which files to keep among the checklist
+	if len(checklist) == 0 {
+		return
+	}
 	var whitelistSlice []string
-	rs.Env().Cr().Select(&whitelistSlice, "SELECT DISTINCT store_fname FROM ir_attachment WHERE store_fname IN ?", checklist)
+	rs.Env().Cr().Select(&whitelistSlice, `
+		SELECT store_fname FROM attachment WHERE store_fname IN (?)
+		UNION
+		SELECT store_fname FROM attachment_version WHERE store_fname IN (?)`, checklist, checklist)
 	whitelist := make(map[string]bool)
 	for _, wl := range whitelistSlice {
 		whitelist[wl] = true
@@ -197,9 +290,10 @@ func attachment_FileGC(rs m.AttachmentSet) {
 	var removed int
 	for _, fName := range checklist {
 		if !whitelist[fName] {
-			err = os.Remove(rSet.FullPath(fName))
-			if err != nil {
-				log.Warn("Unable to FileGC", "file", rSet.FullPath(fName), "error", err)
+			storage, _ := GetAttachmentStorage(attachmentStorageName(fName, ""))
+			err = storage.Delete(rSet, fName)
+			if err != nil && !os.IsNotExist(err) && err != ErrAttachmentNotFound {
+				log.Warn("Unable to FileGC", "file", fName, "error", err)
 				continue
 			}
 			removed++
@@ -214,53 +308,833 @@ func attachment_FileGC(rs m.AttachmentSet) {
 
 }
 
-// ComputeDatas returns the data of the attachment, reading either from file or database
+// RotateEncryptionKeys re-encrypts the files of the filestore that are not encrypted with
+// the current master key, so that former master keys can be removed from the configuration.
+//
+// If encryption is enabled, plain files are encrypted too. If it is disabled, encrypted files are decrypted.
+func attachment_RotateEncryptionKeys(rs m.AttachmentSet) {
+	if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+		log.Panic(rs.T("Only administrators can execute this action."))
+	}
+	keys, err := getFilestoreKeys()
+	if err != nil {
+		log.Panic("Unable to read encryption keys", "error", err)
+	}
+	fileStore := rs.FileStore()
+	if _, err = os.Stat(fileStore); os.IsNotExist(err) {
+		return
+	}
+	var rotated, failed int
+	err = filepath.Walk(fileStore, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == rs.FullPath("checklist") || path == rs.FullPath("tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		newPath, err := rotateFilestoreFile(path, keys)
+		switch {
+		case err != nil:
+			log.Warn("Unable to re-encrypt file", "file", path, "error", err)
+			failed++
+		case newPath != "":
+			rotated++
+		}
+		if newPath == "" || newPath == path {
+			return nil
+		}
+		// The file has been renamed: update its references and collect the old file
+		oldFName, _ := filepath.Rel(fileStore, path)
+		newFName, _ := filepath.Rel(fileStore, newPath)
+		oldFName, newFName = filepath.ToSlash(oldFName), filepath.ToSlash(newFName)
+		rs.Env().Cr().Execute("UPDATE attachment SET store_fname = ? WHERE store_fname = ?", newFName, oldFName)
+		rs.Env().Cr().Execute("UPDATE attachment_version SET store_fname = ? WHERE store_fname = ?", newFName, oldFName)
+		rs.MarkForGC(oldFName)
+		rs.MarkForGC(newFName)
+		return nil
+	})
+	if err != nil {
+		log.Panic("Error while walking the filestore", "error", err)
+	}
+	log.Info("Filestore encryption keys rotated", "rotated", rotated, "failed", failed, "encrypted", keys.current != nil)
+}
+
+// fsckOrphanGracePeriod is the minimum age of an unreferenced file of the filestore
+// to be reported as orphan. Younger files may belong to uncommitted transactions.
+const fsckOrphanGracePeriod = time.Hour
+
+// Fsck checks the consistency of the attachments contents and of the filestore and
+// returns a line for each problem found:
+//
+// - missing: the content of the attachment cannot be found in its storage,
+// - checksum: the content of the attachment does not match its CheckSum,
+// - orphan: a file of the filestore is not referenced by any attachment,
+// - duplicate: the content of the attachment is also stored elsewhere for another attachment.
+//
+// If repair is true, missing and corrupted contents are restored from a valid copy
+// (database data or another attachment with the same checksum) and orphan files are deleted.
+func attachment_Fsck(rs m.AttachmentSet, repair bool) m.AttachmentCheckLineSet {
+	if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+		log.Panic(rs.T("Only administrators can execute this action."))
+	}
+	rSet := rs.Sudo()
+	res := h.AttachmentCheckLine().NewSet(rs.Env())
+	newLine := func(data m.AttachmentCheckLineData) {
+		res = res.Union(h.AttachmentCheckLine().Create(rs.Env(), data))
+	}
+	var ids []int64
+	rs.Env().Cr().Select(&ids, "SELECT id FROM attachment WHERE store_fname IS NOT NULL OR db_datas IS NOT NULL ORDER BY id")
+	attachments := h.Attachment().Browse(rSet.Env(), ids)
+	var versionFnames []string
+	rs.Env().Cr().Select(&versionFnames, "SELECT DISTINCT store_fname FROM attachment_version WHERE store_fname IS NOT NULL")
+
+	// Check contents and collect valid copies
+	validCopies := make(map[string]func() (io.ReadCloser, error))
+	var broken []m.AttachmentSet
+	brokenIssues := make(map[int64]string)
+	referenced := make(map[string]bool)
+	storedBySum := make(map[string]map[string]bool)
+	for _, fName := range versionFnames {
+		referenced[fName] = true
+	}
+	for _, attach := range attachments.Records() {
+		storageName := attach.CurrentStorage()
+		referenced[attach.StoreFname()] = true
+		// Identical contents stored in the same file are deduplicated, but not across storages or in database
+		location := storageName + ":" + storageKey(attach.StoreFname())
+		if storageName == "db" {
+			location = fmt.Sprintf("db:%d", attach.ID())
+		}
+		locations, ok := storedBySum[attach.CheckSum()]
+		if !ok {
+			locations = make(map[string]bool)
+			storedBySum[attach.CheckSum()] = locations
+		}
+		if len(locations) > 0 && !locations[location] {
+			newLine(h.AttachmentCheckLine().NewData().
+				SetIssue("duplicate").
+				SetAttachment(attach).
+				SetStoreFname(attach.StoreFname()).
+				SetCheckSum(attach.CheckSum()))
+		}
+		locations[location] = true
+		if attach.DBDatas() != "" && storageName != "db" {
+			// A database copy is left from a previous storage
+			if sum, err := streamCheckSum(dbStorage{}.Open(attach)); err == nil && sum == attach.CheckSum() {
+				dbCopy := attach
+				validCopies[attach.CheckSum()] = func() (io.ReadCloser, error) { return dbStorage{}.Open(dbCopy) }
+			}
+		}
+		sum, err := streamCheckSum(attach.OpenContent())
+		switch {
+		case err == ErrAttachmentNotFound:
+			brokenIssues[attach.ID()] = "missing"
+		case err != nil:
+			log.Warn("Unable to read attachment", "attachment", attach.ID(), "file", attach.StoreFname(), "error", err)
+			brokenIssues[attach.ID()] = "missing"
+		case attach.CheckSum() != "" && sum != attach.CheckSum():
+			brokenIssues[attach.ID()] = "checksum"
+		default:
+			validCopies[attach.CheckSum()] = attach.OpenContent
+			continue
+		}
+		broken = append(broken, attach)
+	}
+
+	// Report and repair broken contents
+	for _, attach := range broken {
+		line := h.AttachmentCheckLine().NewData().
+			SetIssue(brokenIssues[attach.ID()]).
+			SetAttachment(attach).
+			SetStoreFname(attach.StoreFname()).
+			SetCheckSum(attach.CheckSum())
+		if open, ok := validCopies[attach.CheckSum()]; ok && repair {
+			if brokenIssues[attach.ID()] == "checksum" && attach.CurrentStorage() == "file" {
+				// The corrupted file would be kept as is since it already exists
+				os.Remove(attach.FullPath(attach.StoreFname()))
+			}
+			if r, err := open(); err != nil {
+				log.Warn("Unable to read attachment copy", "attachment", attach.ID(), "error", err)
+			} else {
+				attach.WriteContent(r, attach.MimeType())
+				r.Close()
+				line.SetRepaired(true)
+			}
+		}
+		newLine(line)
+	}
+
+	// Look for orphan files
+	fileStore := rs.FileStore()
+	if _, err := os.Stat(fileStore); os.IsNotExist(err) {
+		return res
+	}
+	err := filepath.Walk(fileStore, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path == rs.FullPath("checklist") || path == rs.FullPath("tmp") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		fName, err := filepath.Rel(fileStore, path)
+		if err != nil {
+			return err
+		}
+		fName = filepath.ToSlash(fName)
+		if referenced[fName] || time.Since(info.ModTime()) < fsckOrphanGracePeriod {
+			return nil
+		}
+		line := h.AttachmentCheckLine().NewData().
+			SetIssue("orphan").
+			SetStoreFname(fName)
+		if repair {
+			if err := os.Remove(path); err != nil {
+				log.Warn("Unable to remove orphan file", "file", path, "error", err)
+			} else {
+				line.SetRepaired(true)
+			}
+		}
+		newLine(line)
+		return nil
+	})
+	if err != nil {
+		log.Panic("Error while walking the filestore", "error", err)
+	}
+	log.Info("Attachments checked", "attachments", attachments.Len(), "issues", res.Len(), "repair", repair)
+	return res
+}
+
+// ComputeDatas returns the data of the attachment, reading from the storage backend that holds it
 func attachment_ComputeDatas(rs m.AttachmentSet) m.AttachmentData {
-	var datas string
-	binSize := rs.Env().Context().GetBool("bin_size")
-	if rs.StoreFname() != "" {
-		datas = rs.FileRead(rs.StoreFname(), binSize)
-	} else {
-		datas = rs.DBDatas()
+	res := h.Attachment().NewData().SetDatas("")
+	storageName := rs.CurrentStorage()
+	switch storageName {
+	case "":
+		return res
+	case "db":
+		if !rs.Env().Context().GetBool("bin_size") {
+			return res.SetDatas(rs.DBDatas())
+		}
+	}
+	if rs.Env().Context().GetBool("bin_size") {
+		storage, _ := GetAttachmentStorage(storageName)
+		size, err := storage.Size(rs)
+		if err != nil {
+			log.Warn("Error while getting attachment size", "attachment", rs.ID(), "file", rs.StoreFname(), "error", err)
+			return res
+		}
+		return res.SetDatas(strutils.HumanSize(size))
 	}
-	return h.Attachment().NewData().SetDatas(datas)
+	r, err := rs.OpenContent()
+	if err != nil {
+		log.Warn("Unable to read attachment", "attachment", rs.ID(), "file", rs.StoreFname(), "error", err)
+		return res
+	}
+	defer r.Close()
+	var data strings.Builder
+	encoder := base64.NewEncoder(base64.StdEncoding, &data)
+	if _, err = io.Copy(encoder, r); err != nil {
+		log.Warn("Unable to read attachment", "attachment", rs.ID(), "file", rs.StoreFname(), "error", err)
+		return res
+	}
+	encoder.Close()
+	return res.SetDatas(data.String())
 }
 
 // InverseDatas stores the given data either in database or in file.
 func attachment_InverseDatas(rs m.AttachmentSet, val string) {
-	vals := rs.GetDatasRelatedValues(val, rs.MimeType())
+	for _, attach := range rs.Records() {
+		attach.WriteContent(base64.NewDecoder(base64.StdEncoding, strings.NewReader(val)), attach.MimeType())
+	}
+}
+
+// OpenContent returns a reader of the binary content of this attachment, whatever the
+// storage backend that holds it. The returned reader must be closed after use.
+//
+// It returns ErrAttachmentNotFound if the content cannot be found in its storage.
+func attachment_OpenContent(rs m.AttachmentSet) (io.ReadCloser, error) {
+	rs.EnsureOne()
+	storageName := rs.CurrentStorage()
+	if storageName == "" {
+		return ioutil.NopCloser(strings.NewReader("")), nil
+	}
+	storage, _ := GetAttachmentStorage(storageName)
+	return storage.Open(rs)
+}
+
+// WriteContent stores the binary content read from r in this attachment.
+//
+// The content is streamed to the storage backend and the checksum, size and index
+// are computed on the fly, so that large contents are never loaded in memory.
+// If mimeType is empty, it is detected from the beginning of the content.
+func attachment_WriteContent(rs m.AttachmentSet, r io.Reader, mimeType string) {
+	rs.EnsureOne()
+	if mimeType == "" {
+		buffered := bufio.NewReader(r)
+		head, _ := buffered.Peek(512)
+		if len(head) > 0 {
+			mimeType = http.DetectContentType(head)
+		}
+		r = buffered
+	}
+	if mimeType != "" && mimeType != rs.MimeType() {
+		// Write the mime type first so that it goes through CheckContents
+		rs.Write(h.Attachment().NewData().SetMimeType(mimeType))
+	}
+	vals := rs.GetContentRelatedValues(r, rs.MimeType())
+	rs.CheckQuota(rs.Company(), vals.FileSize())
+	versioned := rs.Versioned() && rs.CurrentStorage() != "" && rs.CheckSum() != vals.CheckSum()
+	if versioned {
+		rs.CreateVersion()
+	}
 	// take current location in filestore to possibly garbage-collect it
+	// versions keep their files from being collected
 	fName := rs.StoreFname()
 	// write as superuser, as user probably does not have write access
 	rs.Sudo().WithContext("attachment_set_datas", true).Write(vals)
 	if fName != "" {
 		rs.FileDelete(fName)
 	}
+	if versioned {
+		rs.PruneVersions()
+	}
+	if rs.IndexContent() == "" && int64(rs.FileSize()) > attachmentIndexAsyncSize(rs) && canExtractContent(rs.MimeType()) {
+		rs.Enqueue(fmt.Sprintf("Extract content of attachment %s", rs.Name()), h.Attachment().Methods().ExtractIndexContent())
+	}
+	updateThumbnails(rs)
 }
 
-// GetDatasRelatedValues compute the fields that depend on data
-func attachment_GetDatasRelatedValues(rs m.AttachmentSet, data string, mimeType string) m.AttachmentData {
-	var binData string
-	if data != "" {
-		binBytes, err := base64.StdEncoding.DecodeString(data)
+// attachmentIndexAsyncSize returns the size in bytes above which the content of attachments
+// is extracted asynchronously by a queue job. It is set by the 'attachment.index_async_size'
+// configuration parameter and defaults to 1MiB.
+func attachmentIndexAsyncSize(rs m.AttachmentSet) int64 {
+	param := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("attachment.index_async_size", "1048576")
+	size, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		log.Warn("Invalid attachment.index_async_size configuration parameter", "value", param)
+		return 1 << 20
+	}
+	return size
+}
+
+// ExtractContent returns the text to index of the given content of the given MIME type,
+// using the extractor registered for this type.
+func attachment_ExtractContent(rs m.AttachmentSet, r io.ReaderAt, size int64, mimeType string) string {
+	if baseMimeType(mimeType) == "application/zip" {
+		mimeType = zipMimeType(r, size)
+	}
+	extractor, ok := GetContentExtractor(mimeType)
+	if !ok {
+		if strings.Split(mimeType, "/")[0] == "text" {
+			text, _ := ioutil.ReadAll(io.NewSectionReader(r, 0, attachmentIndexMaxSize))
+			return rs.Index(string(text), mimeType)
+		}
+		return ""
+	}
+	text, err := extractor(r, size)
+	if err != nil {
+		log.Warn("Error while extracting attachment content", "mimetype", mimeType, "error", err)
+	}
+	// Normalize white spaces and remove empty lines
+	var res strings.Builder
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line == "" {
+			continue
+		}
+		if res.Len()+len(line) >= attachmentIndexMaxSize {
+			break
+		}
+		res.WriteString(line)
+		res.WriteString("\n")
+	}
+	return strings.TrimSuffix(res.String(), "\n")
+}
+
+// ExtractIndexContent extracts the content of these attachments with the registered
+// extractors and updates their IndexContent.
+//
+// It is called by a queue job for large attachments and can be used to index existing attachments.
+func attachment_ExtractIndexContent(rs m.AttachmentSet) {
+	for _, attach := range rs.Records() {
+		if attach.CurrentStorage() == "" || !canExtractContent(attach.MimeType()) {
+			continue
+		}
+		indexContent, err := extractAttachmentContent(attach)
+		if err != nil {
+			log.Warn("Unable to read attachment", "attachment", attach.ID(), "file", attach.StoreFname(), "error", err)
+			continue
+		}
+		attach.Sudo().WithContext("attachment_set_datas", true).SetIndexContent(indexContent)
+	}
+}
+
+// extractAttachmentContent returns the text to index of the content of the given attachment.
+func extractAttachmentContent(rs m.AttachmentSet) (string, error) {
+	r, err := rs.OpenContent()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	ra, ok := r.(io.ReaderAt)
+	if !ok {
+		// Extractors need random access, so we spool the content to a temporary file
+		content, remove, err := spoolContent(rs, r)
 		if err != nil {
-			log.Panic("Unable to decode attachment content", "error", err)
+			return "", err
+		}
+		defer remove()
+		ra = content
+	}
+	return rs.ExtractContent(ra, int64(rs.FileSize()), rs.MimeType()), nil
+}
+
+// spoolContent copies the content read from r to a temporary file of the filestore and
+// returns a reader of this copy. The caller must call the returned function to remove it.
+func spoolContent(rs m.AttachmentSet, r io.Reader) (readSeekerAt, func(), error) {
+	spool, err := newSpoolFile(rs.FullPath("tmp"))
+	if err != nil {
+		return nil, nil, err
+	}
+	if _, err = io.Copy(spool, r); err != nil {
+		spool.Remove()
+		return nil, nil, err
+	}
+	content, err := spool.Rewind()
+	if err != nil {
+		spool.Remove()
+		return nil, nil, err
+	}
+	return content, spool.Remove, nil
+}
+
+// SearchContent returns the attachments whose name or indexed content contain all
+// the words of the given text, case insensitively.
+func attachment_SearchContent(rs m.AttachmentSet, text string) m.AttachmentSet {
+	words := strings.Fields(text)
+	if len(words) == 0 {
+		return h.Attachment().NewSet(rs.Env())
+	}
+	var cond q.AttachmentCondition
+	for i, word := range words {
+		wordCond := q.Attachment().IndexContent().IContains(word).Or().Name().IContains(word)
+		if i == 0 {
+			cond = wordCond
+			continue
 		}
-		binData = string(binBytes)
+		cond = cond.AndCond(wordCond)
+	}
+	return h.Attachment().Search(rs.Env(), cond)
+}
+
+// ContentSnippet returns the line of the indexed content of this attachment where one of the
+// words of the given text first appears, limited to radius characters around the word.
+// It returns an empty string if none of the words appear in the content.
+func attachment_ContentSnippet(rs m.AttachmentSet, text string, radius int) string {
+	rs.EnsureOne()
+	content := []rune(rs.IndexContent())
+	lowerContent := strings.ToLower(rs.IndexContent())
+	if utf8.RuneCountInString(lowerContent) != len(content) {
+		// Lower casing changed the length of the text
+		lowerContent = rs.IndexContent()
+	}
+	for _, word := range strings.Fields(strings.ToLower(text)) {
+		index := strings.Index(lowerContent, word)
+		if index < 0 {
+			continue
+		}
+		pos := utf8.RuneCountInString(lowerContent[:index])
+		start, end := pos, pos+utf8.RuneCountInString(word)
+		for start > 0 && pos-start < radius && content[start-1] != '\n' {
+			start--
+		}
+		for end < len(content) && end-pos-utf8.RuneCountInString(word) < radius && content[end] != '\n' {
+			end++
+		}
+		snippet := string(content[start:end])
+		if start > 0 && content[start-1] != '\n' {
+			snippet = "…" + snippet
+		}
+		if end < len(content) && content[end] != '\n' {
+			snippet += "…"
+		}
+		return snippet
+	}
+	return ""
+}
+
+// CheckQuota panics if storing a content of the given size in an attachment of the given
+// company would exceed one of the quotas that apply to the company, the current user or
+// one of its groups.
+//
+// This RecordSet is either empty for a new content, or the attachment whose content is replaced.
+// Contents are always checked by WriteContent, and thus in Create and Write when Datas is set.
+func attachment_CheckQuota(rs m.AttachmentSet, company m.CompanySet, fileSize int) {
+	user := h.User().NewSet(rs.Env()).CurrentUser()
+	cond := q.AttachmentQuota().User().Equals(user).Or().Group().In(user.Groups())
+	if company.IsNotEmpty() {
+		cond = cond.Or().Company().Equals(company)
+	}
+	quotas := h.AttachmentQuota().NewSet(rs.Env()).Sudo().Search(cond)
+	if quotas.IsEmpty() {
+		return
+	}
+	added := int64(fileSize)
+	if rs.IsNotEmpty() && !rs.Versioned() {
+		// The current content will be released
+		added -= int64(rs.FileSize())
+	}
+	for _, quota := range quotas.Records() {
+		if quota.MaxFileSize() > 0 && int64(fileSize) > quota.MaxFileSize() {
+			panic(rs.T("This file is too large (%s). The maximum file size is %s.",
+				strutils.HumanSize(int64(fileSize)), strutils.HumanSize(quota.MaxFileSize())))
+		}
+		if quota.MaxTotalSize() <= 0 || added <= 0 {
+			continue
+		}
+		owner := user.Name()
+		usage := attachmentUsage(rs, "create_uid", user.ID())
+		if quota.Company().IsNotEmpty() {
+			owner = quota.Company().Name()
+			usage = attachmentUsage(rs, "company_id", quota.Company().ID())
+		}
+		if usage+added > quota.MaxTotalSize() {
+			panic(rs.T("The attachment storage quota of %s is exceeded: %s are used out of %s.",
+				owner, strutils.HumanSize(usage), strutils.HumanSize(quota.MaxTotalSize())))
+		}
+	}
+}
+
+// attachmentUsage returns the total size of the attachments and their versions
+// whose given column has the given value.
+func attachmentUsage(rs m.AttachmentSet, column string, value int64) int64 {
+	var usage int64
+	rs.Env().Cr().Get(&usage, fmt.Sprintf(`
+		SELECT COALESCE(SUM(size), 0) FROM (
+			SELECT file_size AS size FROM attachment WHERE %[1]s = ?
+			UNION ALL
+			SELECT v.file_size FROM attachment_version v JOIN attachment a ON a.id = v.attachment_id WHERE a.%[1]s = ?
+		) sizes`, column), value, value)
+	return usage
+}
+
+// UsageReport returns the number and total size of attachments by company, model and user.
+func attachment_UsageReport(rs m.AttachmentSet) m.AttachmentUsageLineSet {
+	if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+		log.Panic(rs.T("Only administrators can execute this action."))
+	}
+	var rows []struct {
+		CompanyID    sql.NullInt64  `db:"company_id"`
+		ResModel     sql.NullString `db:"res_model"`
+		CreateUID    sql.NullInt64  `db:"create_uid"`
+		Count        int64          `db:"count"`
+		TotalSize    int64          `db:"total_size"`
+		VersionsSize int64          `db:"versions_size"`
+	}
+	rs.Env().Cr().Select(&rows, `
+		SELECT a.company_id, a.res_model, a.create_uid, COUNT(*) AS count,
+			COALESCE(SUM(a.file_size), 0) AS total_size, COALESCE(SUM(v.size), 0) AS versions_size
+		FROM attachment a
+		LEFT JOIN (
+			SELECT attachment_id, SUM(file_size) AS size FROM attachment_version GROUP BY attachment_id
+		) v ON v.attachment_id = a.id
+		GROUP BY a.company_id, a.res_model, a.create_uid
+		ORDER BY total_size DESC`)
+	res := h.AttachmentUsageLine().NewSet(rs.Env())
+	for _, row := range rows {
+		res = res.Union(h.AttachmentUsageLine().Create(rs.Env(), h.AttachmentUsageLine().NewData().
+			SetCompany(h.Company().BrowseOne(rs.Env(), row.CompanyID.Int64)).
+			SetResModel(row.ResModel.String).
+			SetUser(h.User().BrowseOne(rs.Env(), row.CreateUID.Int64)).
+			SetCount(row.Count).
+			SetTotalSize(row.TotalSize).
+			SetVersionsSize(row.VersionsSize)))
+	}
+	return res
+}
+
+// CreateVersion saves the current content of this attachment as a new version.
+func attachment_CreateVersion(rs m.AttachmentSet) m.AttachmentVersionSet {
+	rs.EnsureOne()
+	var lastVersion int64
+	rs.Env().Cr().Get(&lastVersion, "SELECT COALESCE(MAX(version), 0) FROM attachment_version WHERE attachment_id = ?", rs.ID())
+	authorID := rs.WriteUID()
+	if authorID == 0 {
+		authorID = rs.CreateUID()
+	}
+	return h.AttachmentVersion().NewSet(rs.Env()).Sudo().Create(h.AttachmentVersion().NewData().
+		SetAttachment(rs).
+		SetVersion(lastVersion + 1).
+		SetAuthor(h.User().BrowseOne(rs.Env(), authorID)).
+		SetDate(rs.LastUpdate()).
+		SetDBDatas(rs.DBDatas()).
+		SetStoreFname(rs.StoreFname()).
+		SetFileSize(rs.FileSize()).
+		SetCheckSum(rs.CheckSum()).
+		SetMimeType(rs.MimeType()).
+		SetIndexContent(rs.IndexContent()))
+}
+
+// Versions returns the previous contents of this attachment, latest first.
+func attachment_Versions(rs m.AttachmentSet) m.AttachmentVersionSet {
+	rs.EnsureOne()
+	rs.Check("read", nil)
+	return h.AttachmentVersion().Search(rs.Env(), q.AttachmentVersion().Attachment().Equals(rs)).OrderBy("Version desc")
+}
+
+// RestoreVersion sets the content of the given version number as the current content of
+// this attachment. The current content is kept as a new version if the attachment is versioned.
+func attachment_RestoreVersion(rs m.AttachmentSet, number int64) {
+	rs.EnsureOne()
+	rs.Check("write", nil)
+	version := h.AttachmentVersion().NewSet(rs.Env()).Sudo().Search(
+		q.AttachmentVersion().Attachment().Equals(rs).And().Version().Equals(number))
+	if version.IsEmpty() {
+		panic(rs.T("Version %d of attachment %s does not exist", number, rs.Name()))
+	}
+	rs.CheckQuota(rs.Company(), version.FileSize())
+	versioned := rs.Versioned() && rs.CurrentStorage() != "" && rs.CheckSum() != version.CheckSum()
+	if versioned {
+		rs.CreateVersion()
+	}
+	fName := rs.StoreFname()
+	// Contents are addressed by checksum, so that restoring only needs to copy references
+	rs.Sudo().WithContext("attachment_set_datas", true).Write(h.Attachment().NewData().
+		SetDBDatas(version.DBDatas()).
+		SetStoreFname(version.StoreFname()).
+		SetFileSize(version.FileSize()).
+		SetCheckSum(version.CheckSum()).
+		SetMimeType(version.MimeType()).
+		SetIndexContent(version.IndexContent()))
+	if fName != "" {
+		rs.FileDelete(fName)
+	}
+	if versioned {
+		rs.PruneVersions()
+	}
+	updateThumbnails(rs)
+}
+
+// updateThumbnails generates the thumbnails of the given attachment after its content changed.
+// Thumbnails of contents larger than the 'attachment.thumbnail_async_size' configuration
+// parameter (1MiB by default) are generated by a queue job.
+func updateThumbnails(rs m.AttachmentSet) {
+	if _, ok := GetThumbnailRenderer(rs.MimeType()); !ok || rs.CurrentStorage() == "" {
+		if rs.Thumbnail512() != "" {
+			rs.Sudo().WithContext("attachment_set_datas", true).Write(h.Attachment().NewData().
+				SetThumbnail512("").
+				SetThumbnail256("").
+				SetThumbnail128(""))
+		}
+		return
+	}
+	param := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("attachment.thumbnail_async_size", "1048576")
+	asyncSize, err := strconv.Atoi(param)
+	if err != nil {
+		log.Warn("Invalid attachment.thumbnail_async_size configuration parameter", "value", param)
+		asyncSize = 1 << 20
+	}
+	if rs.FileSize() > asyncSize {
+		rs.Enqueue(fmt.Sprintf("Generate thumbnails of attachment %s", rs.Name()), h.Attachment().Methods().GenerateThumbnails())
+		return
+	}
+	rs.GenerateThumbnails()
+}
+
+// GenerateThumbnails renders and stores the thumbnails of these attachments with the
+// renderer registered for their MIME type.
+func attachment_GenerateThumbnails(rs m.AttachmentSet) {
+	for _, attach := range rs.Records() {
+		renderer, ok := GetThumbnailRenderer(attach.MimeType())
+		if !ok || attach.CurrentStorage() == "" {
+			continue
+		}
+		r, err := attach.OpenContent()
+		if err != nil {
+			log.Warn("Unable to read attachment", "attachment", attach.ID(), "file", attach.StoreFname(), "error", err)
+			continue
+		}
+		img, err := renderer(r)
+		r.Close()
+		if err != nil {
+			log.Warn("Unable to render attachment thumbnail", "attachment", attach.ID(), "mimetype", attach.MimeType(), "error", err)
+			img = ""
+		}
+		thumbnails := h.Attachment().NewData().
+			SetThumbnail512("").
+			SetThumbnail256("").
+			SetThumbnail128("")
+		if img != "" {
+			thumbnails.SetThumbnail512(b64image.Resize(img, 512, 512, true)).
+				SetThumbnail256(b64image.Resize(img, 256, 256, true)).
+				SetThumbnail128(b64image.Resize(img, 128, 128, true))
+		}
+		attach.Sudo().WithContext("attachment_set_datas", true).Write(thumbnails)
+	}
+}
+
+// Thumbnail returns a base64 encoded thumbnail of this attachment that fits in a square
+// of the given size, or an empty string if this attachment has no thumbnail.
+//
+// Stored thumbnails are returned for sizes 512, 256 and 128. Other sizes are resized on
+// the fly from the closest larger thumbnail. The largest thumbnail is returned if size is 0.
+func attachment_Thumbnail(rs m.AttachmentSet, size int) string {
+	rs.EnsureOne()
+	if size <= 0 {
+		return rs.Thumbnail512()
+	}
+	thumbnails := []struct {
+		size  int
+		image string
+	}{
+		{128, rs.Thumbnail128()},
+		{256, rs.Thumbnail256()},
+		{512, rs.Thumbnail512()},
+	}
+	for i, thumbnail := range thumbnails {
+		if thumbnail.image == "" {
+			return ""
+		}
+		switch {
+		case thumbnail.size == size:
+			return thumbnail.image
+		case thumbnail.size > size || i == len(thumbnails)-1:
+			return b64image.Resize(thumbnail.image, size, size, true)
+		}
+	}
+	return ""
+}
+
+// PruneVersions removes the versions of these attachments, or of all attachments if this
+// RecordSet is empty, that fall out of the retention policy defined by the following
+// configuration parameters:
+//
+// - attachment.version_keep: number of versions to keep for each attachment,
+// - attachment.version_days: number of days during which versions are kept.
+//
+// Both are unlimited if unset or 0. It returns the number of removed versions.
+func attachment_PruneVersions(rs m.AttachmentSet) int {
+	configParams := h.ConfigParameter().NewSet(rs.Env()).Sudo()
+	keep, _ := strconv.Atoi(configParams.GetParam("attachment.version_keep", "0"))
+	days, _ := strconv.Atoi(configParams.GetParam("attachment.version_days", "0"))
+	if keep <= 0 && days <= 0 {
+		return 0
+	}
+	cond := q.AttachmentVersion().ID().IsNotNull()
+	if rs.IsNotEmpty() {
+		cond = q.AttachmentVersion().Attachment().In(rs)
+	}
+	limit := dates.Now().AddDate(0, 0, -days)
+	toRemove := h.AttachmentVersion().NewSet(rs.Env()).Sudo()
+	counts := make(map[int64]int)
+	versions := h.AttachmentVersion().NewSet(rs.Env()).Sudo().Search(cond).OrderBy("Attachment", "Version desc")
+	for _, version := range versions.Records() {
+		counts[version.Attachment().ID()]++
+		if (keep > 0 && counts[version.Attachment().ID()] > keep) || (days > 0 && version.Date().Lower(limit)) {
+			toRemove = toRemove.Union(version)
+		}
+	}
+	toRemove.Unlink()
+	return toRemove.Len()
+}
+
+// GetDatasRelatedValues compute the fields that depend on data
+func attachment_GetDatasRelatedValues(rs m.AttachmentSet, data string, mimeType string) m.AttachmentData {
+	return rs.GetContentRelatedValues(base64.NewDecoder(base64.StdEncoding, strings.NewReader(data)), mimeType)
+}
+
+// attachmentIndexMaxSize is the maximum number of bytes of a content that are indexed
+const attachmentIndexMaxSize = 10 << 20
+
+// GetContentRelatedValues stores the binary content read from r in the configured storage
+// backend and returns the fields that depend on it.
+//
+// The content is first spooled to a temporary file of the filestore while its checksum
+// and size are computed, so that backends get a seekable content of known size.
+func attachment_GetContentRelatedValues(rs m.AttachmentSet, r io.Reader, mimeType string) m.AttachmentData {
+	spool, err := newSpoolFile(rs.FullPath("tmp"))
+	if err != nil {
+		log.Panic("Unable to create temporary file for attachment content", "error", err)
+	}
+	defer spool.Remove()
+	hasher := sha1.New()
+	index := &limitedBuffer{limit: attachmentIndexMaxSize}
+	writers := []io.Writer{spool, hasher}
+	if strings.Split(mimeType, "/")[0] == "text" {
+		writers = append(writers, index)
+	}
+	size, err := io.Copy(io.MultiWriter(writers...), r)
+	if err != nil {
+		log.Panic("Unable to read attachment content", "error", err)
 	}
 	values := h.Attachment().NewData().
-		SetFileSize(len(binData)).
-		SetCheckSum(rs.ComputeCheckSum(binData)).
-		SetIndexContent(rs.Index(binData, mimeType)).
-		SetDBDatas(data)
-	if data != "" && rs.Storage() != "db" {
-		// Save the file to the filestore
-		values.SetStoreFname(rs.FileWrite(data, values.CheckSum()))
-		values.SetDBDatas("")
+		SetFileSize(int(size)).
+		SetCheckSum(fmt.Sprintf("%x", hasher.Sum(nil))).
+		SetIndexContent(rs.Index(index.String(), mimeType)).
+		SetDBDatas("").
+		SetStoreFname("")
+	if size == 0 {
+		return values
+	}
+	content, err := spool.Rewind()
+	if err != nil {
+		log.Panic("Unable to read attachment content", "error", err)
 	}
+	if size <= attachmentIndexAsyncSize(rs) && canExtractContent(mimeType) {
+		values.SetIndexContent(rs.ExtractContent(content, size, mimeType))
+	}
+	// Save the content to the storage backend
+	if content, err = spool.Rewind(); err != nil {
+		log.Panic("Unable to read attachment content", "error", err)
+	}
+	storageValues, err := storageBackend(rs).Write(rs, content, size, values.CheckSum())
+	if err != nil {
+		log.Panic("Unable to store attachment content", "storage", rs.Storage(), "error", err)
+	}
+	values.SetDBDatas(storageValues.DBDatas())
+	values.SetStoreFname(storageValues.StoreFname())
 	return values
 }
 
+// limitedBuffer is an io.Writer that keeps the first limit bytes written to it and
+// silently discards the others.
+type limitedBuffer struct {
+	strings.Builder
+	limit int
+}
+
+// Write method of the limitedBuffer
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if remaining := lb.limit - lb.Len(); remaining > 0 {
+		if len(p) > remaining {
+			lb.Builder.Write(p[:remaining])
+		} else {
+			lb.Builder.Write(p)
+		}
+	}
+	return len(p), nil
+}
+
+// streamCheckSum returns the SHA1 checksum of the content of the given reader and closes it.
+// It is meant to be called directly with the results of an Open method.
+func streamCheckSum(r io.ReadCloser, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hasher := sha1.New()
+	if _, err = io.Copy(hasher, r); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", hasher.Sum(nil)), nil
+}
+
 // ComputeCheckSum computes the SHA1 checksum of the given data
 func attachment_ComputeCheckSum(_ m.AttachmentSet, data string) string {
 	return fmt.Sprintf("%x", sha1.Sum([]byte(data)))
@@ -270,7 +1144,13 @@ func attachment_ComputeCheckSum(_ m.AttachmentSet, data string) string {
 func attachment_ComputeMimeType(_ m.AttachmentSet, values m.AttachmentData) string {
 	mimeType := values.MimeType()
 	if mimeType == "" && values.Datas() != "" {
-		mimeType = http.DetectContentType([]byte(values.Datas()))
+		// Only the first 512 bytes are used to detect the content type
+		head := values.Datas()
+		if len(head) > 684 {
+			head = head[:684]
+		}
+		data, _ := base64.StdEncoding.DecodeString(head)
+		mimeType = http.DetectContentType(data)
 	}
 	if mimeType == "" {
 		mimeType = "application/octet-stream"
@@ -513,6 +1393,11 @@ func attachment_Write(rs m.AttachmentSet, vals m.AttachmentData) bool {
 	if vals.HasMimeType() || vals.HasDatas() {
 		vals = rs.CheckContents(vals)
 	}
+	if vals.HasDatas() {
+		// Datas inverse method is called before the other fields are updated, so we
+		// write the new MIME type first for the new content to be processed accordingly.
+		rs.Super().Write(h.Attachment().NewData().SetMimeType(vals.MimeType()))
+	}
 	return rs.Super().Write(vals)
 }
 
@@ -534,6 +1419,13 @@ func attachment_Unlink(rs m.AttachmentSet) int64 {
 	for _, attach := range rs.Records() {
 		toDelete[attach.StoreFname()] = true
 	}
+	// versions are deleted in cascade by the database
+	var versionFnames []string
+	rs.Env().Cr().Select(&versionFnames,
+		"SELECT DISTINCT store_fname FROM attachment_version WHERE attachment_id IN (?) AND store_fname IS NOT NULL", rs.Ids())
+	for _, fName := range versionFnames {
+		toDelete[fName] = true
+	}
 	res := rs.Super().Unlink()
 	for filePath := range toDelete {
 		rs.FileDelete(filePath)
@@ -577,11 +1469,130 @@ func attachment_GenerateToken(_ m.AttachmentSet) string {
 	return uuid.New().String()
 }
 
+// GenerateSignedToken returns an access token for this attachment that expires after the
+// given validity. If validity is not positive, the 'attachment.token_validity' configuration
+// parameter is used, in seconds, and defaults to one day. If ip is not empty, the token is
+// only valid for requests coming from this IP address.
+//
+// Unlike the tokens of GenerateAccessToken, signed tokens are not stored and can be
+// verified without reading the attachment.
+func attachment_GenerateSignedToken(rs m.AttachmentSet, validity time.Duration, ip string) string {
+	rs.EnsureOne()
+	rs.Check("read", nil)
+	if validity <= 0 {
+		param := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("attachment.token_validity", "86400")
+		seconds, err := strconv.ParseInt(param, 10, 64)
+		if err != nil {
+			log.Warn("Invalid attachment.token_validity configuration parameter", "value", param)
+			seconds = 86400
+		}
+		validity = time.Duration(seconds) * time.Second
+	}
+	return newSignedToken(attachmentTokenKey(rs.Env()), rs.ID(), time.Now().Add(validity), ip)
+}
+
+// attachmentTokenKey returns the key used to sign attachment access tokens.
+// It is made of the 'database.secret' configuration parameter, which is created if
+// missing, and of the 'attachment.token_salt' one, which is renewed when tokens are revoked.
+func attachmentTokenKey(env models.Environment) []byte {
+	params := h.ConfigParameter().NewSet(env).Sudo()
+	secret := params.GetParam("database.secret", "")
+	if secret == "" {
+		var groups m.GroupSet
+		secret, groups = defaultParameters["database.secret"](env)
+		params.SetParam("database.secret", secret).LimitToGroups(groups)
+	}
+	return []byte(secret + params.GetParam("attachment.token_salt", ""))
+}
+
+// CheckAccessToken returns true if the given token grants access to this attachment
+// for a request coming from the given IP address. The token may either be the permanent
+// token of this attachment or a signed token.
+func attachment_CheckAccessToken(rs m.AttachmentSet, token, ip string) bool {
+	rs.EnsureOne()
+	if token == "" {
+		return false
+	}
+	if isSignedToken(token) {
+		id, err := verifySignedToken(attachmentTokenKey(rs.Env()), token, ip, time.Now())
+		return err == nil && id == rs.ID()
+	}
+	accessToken := rs.Sudo().AccessToken()
+	return accessToken != "" && hmac.Equal([]byte(accessToken), []byte(token))
+}
+
+// GetByAccessToken returns the attachment the given token grants access to for a request
+// coming from the given IP address, or an empty recordset if the token is not valid.
+//
+// The returned attachment is in superuser mode, so that it can be served to users without
+// read access on it.
+func attachment_GetByAccessToken(rs m.AttachmentSet, token, ip string) m.AttachmentSet {
+	if token == "" {
+		return h.Attachment().NewSet(rs.Env())
+	}
+	if isSignedToken(token) {
+		id, err := verifySignedToken(attachmentTokenKey(rs.Env()), token, ip, time.Now())
+		if err != nil {
+			log.Debug("Rejected attachment access token", "error", err, "ip", ip)
+			return h.Attachment().NewSet(rs.Env())
+		}
+		return h.Attachment().NewSet(rs.Env()).Sudo().Search(q.Attachment().ID().Equals(id))
+	}
+	return h.Attachment().NewSet(rs.Env()).Sudo().Search(q.Attachment().AccessToken().Equals(token)).Limit(1)
+}
+
+// RevokeAccessTokens revokes the access tokens of these attachments, or of all
+// attachments if this recordset is empty.
+//
+// Permanent tokens are removed from the given attachments. Signed tokens cannot be revoked
+// individually since they are verified without reading the attachment: all signed tokens
+// of all attachments are revoked by renewing the signing key.
+func attachment_RevokeAccessTokens(rs m.AttachmentSet) {
+	if !h.User().NewSet(rs.Env()).CurrentUser().IsAdmin() {
+		log.Panic(rs.T("Only administrators can execute this action."))
+	}
+	attachments := rs.Sudo()
+	if rs.IsEmpty() {
+		attachments = h.Attachment().NewSet(rs.Env()).Sudo().Search(q.Attachment().AccessToken().IsNotNull())
+	}
+	if attachments.IsNotEmpty() {
+		attachments.WithContext("attachment_set_datas", true).SetAccessToken("")
+	}
+	h.ConfigParameter().NewSet(rs.Env()).Sudo().SetParam("attachment.token_salt", uuid.New().String())
+}
+
 // ActionGet returns the action for displaying attachments
 func attachment_ActionGet(_ m.AttachmentSet) *actions.Action {
 	return actions.Registry.MustGetByXMLID("base_action_attachment")
 }
 
+// Load method of the AttachmentVersion model.
+// Versions can only be read by users who can read their attachment.
+func attachmentVersion_Load(rs m.AttachmentVersionSet, fields ...models.FieldName) m.AttachmentVersionSet {
+	if rs.IsNotEmpty() {
+		var attachIds []int64
+		rs.Env().Cr().Select(&attachIds, "SELECT DISTINCT attachment_id FROM attachment_version WHERE id IN (?)", rs.Ids())
+		h.Attachment().Browse(rs.Env(), attachIds).Check("read", nil)
+	}
+	return rs.Super().Load(fields...)
+}
+
+// Unlink method of the AttachmentVersion model.
+// It marks the files of the deleted versions for garbage collection.
+func attachmentVersion_Unlink(rs m.AttachmentVersionSet) int64 {
+	toDelete := make(map[string]bool)
+	for _, version := range rs.Records() {
+		if version.StoreFname() != "" {
+			toDelete[version.StoreFname()] = true
+		}
+	}
+	res := rs.Super().Unlink()
+	for fName := range toDelete {
+		h.Attachment().NewSet(rs.Env()).FileDelete(fName)
+	}
+	return res
+}
+
 // GetServeAttachment returns the serve attachments
 func attachment_GetServeAttachment(rs m.AttachmentSet, url string, extraCond q.AttachmentCondition, extraFields models.FieldNames, orders []string) []models.RecordData {
 	cond := q.Attachment().Type().Equals("binary").And().URL().Equals(url).AndCond(extraCond)
@@ -590,6 +1601,50 @@ func attachment_GetServeAttachment(rs m.AttachmentSet, url string, extraCond q.A
 	return attachments.Read(fieldNames)
 }
 
+// FindServedAttachment returns the attachment to serve over HTTP given either its id, its
+// access token or its URL, or an empty recordset if there is no such attachment.
+//
+// It panics if the current user is not allowed to read the attachment. Attachments found
+// by their access token are returned in superuser mode since the token grants access to them.
+// Attachments found by their URL are only served if they have been written by a member of
+// the serving groups, so that users cannot hijack URLs with their own attachments.
+func attachment_FindServedAttachment(rs m.AttachmentSet, id int64, url, token, ip string) m.AttachmentSet {
+	var attachment m.AttachmentSet
+	switch {
+	case token != "":
+		attachment = rs.GetByAccessToken(token, ip)
+		if id != 0 && attachment.IsNotEmpty() && attachment.ID() != id {
+			return h.Attachment().NewSet(rs.Env())
+		}
+		return attachment
+	case id != 0:
+		attachment = h.Attachment().Search(rs.Env(), q.Attachment().ID().Equals(id))
+	case url != "":
+		attachment = h.Attachment().NewSet(rs.Env()).Sudo().Search(
+			q.Attachment().Type().Equals("binary").And().URL().Equals(url)).OrderBy("ID desc").Limit(1)
+		if attachment.IsEmpty() {
+			return attachment
+		}
+		attachment.Sudo(attachment.WriteUID()).CheckServingAttachments()
+		attachment = attachment.Sudo(rs.Env().Uid())
+	default:
+		return h.Attachment().NewSet(rs.Env())
+	}
+	if attachment.IsNotEmpty() {
+		attachment.Check("read", nil)
+	}
+	return attachment
+}
+
+// SignedURL returns the URL at which this attachment can be downloaded without
+// session for the given validity, with a token generated by GenerateSignedToken.
+func attachment_SignedURL(rs m.AttachmentSet, validity time.Duration, ip string) string {
+	rs.EnsureOne()
+	token := rs.GenerateSignedToken(validity, ip)
+	baseURL := h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("web.base.url", "")
+	return fmt.Sprintf("%s/attachment/%d?access_token=%s", strings.TrimSuffix(baseURL, "/"), rs.ID(), token)
+}
+
 // GetAttachmentByKey returns the attachment with the given key
 func attachment_GetAttachmentByKey(rs m.AttachmentSet, key string, extraCond q.AttachmentCondition, orders []string) m.AttachmentSet {
 	cond := q.Attachment().HexyaExternalID().Equals(key).AndCond(extraCond)
@@ -603,6 +1658,7 @@ func init() {
 
 	h.Attachment().NewMethod("ComputeResName", attachment_ComputeResName)
 	h.Attachment().NewMethod("Storage", attachment_Storage)
+	h.Attachment().NewMethod("CurrentStorage", attachment_CurrentStorage)
 	h.Attachment().NewMethod("FileStore", attachment_FileStore)
 	h.Attachment().NewMethod("ForceStorage", attachment_ForceStorage)
 	h.Attachment().NewMethod("FullPath", attachment_FullPath)
@@ -612,9 +1668,26 @@ func init() {
 	h.Attachment().NewMethod("FileDelete", attachment_FileDelete)
 	h.Attachment().NewMethod("MarkForGC", attachment_MarkForGC)
 	h.Attachment().NewMethod("FileGC", attachment_FileGC)
+	h.Attachment().NewMethod("RotateEncryptionKeys", attachment_RotateEncryptionKeys)
+	h.Attachment().NewMethod("Fsck", attachment_Fsck)
 	h.Attachment().NewMethod("ComputeDatas", attachment_ComputeDatas)
 	h.Attachment().NewMethod("InverseDatas", attachment_InverseDatas)
+	h.Attachment().NewMethod("OpenContent", attachment_OpenContent)
+	h.Attachment().NewMethod("WriteContent", attachment_WriteContent)
+	h.Attachment().NewMethod("ExtractContent", attachment_ExtractContent)
+	h.Attachment().NewMethod("ExtractIndexContent", attachment_ExtractIndexContent)
+	h.Attachment().NewMethod("SearchContent", attachment_SearchContent)
+	h.Attachment().NewMethod("ContentSnippet", attachment_ContentSnippet)
+	h.Attachment().NewMethod("GenerateThumbnails", attachment_GenerateThumbnails)
+	h.Attachment().NewMethod("Thumbnail", attachment_Thumbnail)
+	h.Attachment().NewMethod("CheckQuota", attachment_CheckQuota)
+	h.Attachment().NewMethod("UsageReport", attachment_UsageReport)
+	h.Attachment().NewMethod("CreateVersion", attachment_CreateVersion)
+	h.Attachment().NewMethod("Versions", attachment_Versions)
+	h.Attachment().NewMethod("RestoreVersion", attachment_RestoreVersion)
+	h.Attachment().NewMethod("PruneVersions", attachment_PruneVersions)
 	h.Attachment().NewMethod("GetDatasRelatedValues", attachment_GetDatasRelatedValues)
+	h.Attachment().NewMethod("GetContentRelatedValues", attachment_GetContentRelatedValues)
 	h.Attachment().NewMethod("ComputeCheckSum", attachment_ComputeCheckSum)
 	h.Attachment().NewMethod("ComputeMimeType", attachment_ComputeMimeType)
 	h.Attachment().NewMethod("CheckContents", attachment_CheckContents)
@@ -633,7 +1706,31 @@ func init() {
 	h.Attachment().NewMethod("PostAddCreate", attachment_PostAddCreate)
 	h.Attachment().NewMethod("GenerateAccessToken", attachment_GenerateAccessToken)
 	h.Attachment().NewMethod("GenerateToken", attachment_GenerateToken)
+	h.Attachment().NewMethod("GenerateSignedToken", attachment_GenerateSignedToken)
+	h.Attachment().NewMethod("CheckAccessToken", attachment_CheckAccessToken)
+	h.Attachment().NewMethod("GetByAccessToken", attachment_GetByAccessToken)
+	h.Attachment().NewMethod("RevokeAccessTokens", attachment_RevokeAccessTokens)
 	h.Attachment().NewMethod("ActionGet", attachment_ActionGet)
 	h.Attachment().NewMethod("GetServeAttachment", attachment_GetServeAttachment)
 	h.Attachment().NewMethod("GetAttachmentByKey", attachment_GetAttachmentByKey)
+	h.Attachment().NewMethod("FindServedAttachment", attachment_FindServedAttachment)
+	h.Attachment().NewMethod("SignedURL", attachment_SignedURL)
+
+	models.NewModel("AttachmentVersion")
+	h.AttachmentVersion().SetDefaultOrder("Version desc")
+	h.AttachmentVersion().AddFields(fields_AttachmentVersion)
+	h.AttachmentVersion().Methods().Load().Extend(attachmentVersion_Load)
+	h.AttachmentVersion().Methods().Unlink().Extend(attachmentVersion_Unlink)
+
+	models.NewModel("AttachmentQuota")
+	h.AttachmentQuota().AddFields(fields_AttachmentQuota)
+	h.AttachmentQuota().AddSQLConstraint("check_scope",
+		"CHECK( (company_id IS NOT NULL)::int + (user_id IS NOT NULL)::int + (group_id IS NOT NULL)::int = 1 )",
+		"A quota must apply to exactly one company, user or group.")
+
+	models.NewTransientModel("AttachmentUsageLine")
+	h.AttachmentUsageLine().AddFields(fields_AttachmentUsageLine)
+
+	models.NewTransientModel("AttachmentCheckLine")
+	h.AttachmentCheckLine().AddFields(fields_AttachmentCheckLine)
 }
@@ -0,0 +1,248 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hexya-erp/hexya/src/controllers"
+	"github.com/hexya-erp/hexya/src/models"
+	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/server"
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+)
+
+// attachmentContentInfo holds the attachment data needed to serve its content over HTTP
+type attachmentContentInfo struct {
+	name       string
+	mimeType   string
+	checkSum   string
+	lastUpdate time.Time
+	public     bool
+	download   bool
+}
+
+// etag returns the ETag header value of the attachment, which is its quoted checksum
+func (aci attachmentContentInfo) etag() string {
+	if aci.checkSum == "" {
+		return ""
+	}
+	return fmt.Sprintf(`"%s"`, aci.checkSum)
+}
+
+// contentDisposition returns the value of the Content-Disposition header for the
+// given disposition type and file name, with an ASCII fallback of the file name
+// for clients that do not support RFC 6266 extended parameters.
+func contentDisposition(disposition, fileName string) string {
+	if fileName == "" {
+		return disposition
+	}
+	fallback := strings.Map(func(r rune) rune {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, fileName)
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, fallback, url.PathEscape(fileName))
+}
+
+// setAttachmentHeaders sets the headers of the HTTP response serving the attachment described by info
+func setAttachmentHeaders(w http.ResponseWriter, info attachmentContentInfo) {
+	mimeType := info.mimeType
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", mimeType)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	disposition := "inline"
+	if info.download {
+		disposition = "attachment"
+	}
+	w.Header().Set("Content-Disposition", contentDisposition(disposition, info.name))
+	// Clients must revalidate with the ETag since the content of an attachment can change
+	if info.public {
+		w.Header().Set("Cache-Control", "public, no-cache")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	if etag := info.etag(); etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+}
+
+// attachmentNotModified returns true if the client already has the version of
+// the attachment with the given ETag, so that it is not necessary to open its content.
+func attachmentNotModified(r *http.Request, etag string) bool {
+	if etag == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == etag || candidate == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAttachmentContent writes the given content of the attachment described by info in
+// the HTTP response. Range, If-Range, If-None-Match and If-Modified-Since requests are handled.
+func serveAttachmentContent(w http.ResponseWriter, r *http.Request, content io.ReadSeeker, info attachmentContentInfo) {
+	setAttachmentHeaders(w, info)
+	http.ServeContent(w, r, "", info.lastUpdate, content)
+}
+
+// streamAttachmentContent writes the given size bytes long content of the attachment described
+// by info in the HTTP response. It is used for contents that are not seekable, for which Range
+// requests cannot be honoured, so that the full content is always sent.
+func streamAttachmentContent(w http.ResponseWriter, r *http.Request, content io.Reader, size int64, info attachmentContentInfo) {
+	setAttachmentHeaders(w, info)
+	w.Header().Set("Accept-Ranges", "none")
+	if !info.lastUpdate.IsZero() {
+		w.Header().Set("Last-Modified", info.lastUpdate.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+	if _, err := io.CopyN(w, content, size); err != nil {
+		log.Debug("Unable to write attachment content", "name", info.name, "error", err)
+	}
+}
+
+// publicUserID returns the id of the public user, as which requests without session are executed
+func publicUserID() (int64, error) {
+	var uid int64
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		uid = h.User().NewSet(env).GetRecord("base_public_user").ID()
+	})
+	return uid, err
+}
+
+// ServeAttachment is the controller that serves the content of attachments over HTTP.
+//
+// The attachment is given either by the 'id' path parameter, by the 'access_token' query
+// parameter or by the 'url' query parameter for binary attachments with a URL. Setting the
+// 'download' query parameter to "true" makes browsers download the file instead of displaying it.
+//
+// Requests without session are executed as the public user and can only access attachments
+// with an access token, or public ones.
+func ServeAttachment(c *server.Context) {
+	var id int64
+	if idParam := c.Param("id"); idParam != "" {
+		var err error
+		id, err = strconv.ParseInt(idParam, 10, 64)
+		if err != nil || id <= 0 {
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
+	}
+	attachURL := c.Query("url")
+	token := c.Query("access_token")
+	if id == 0 && attachURL == "" && token == "" {
+		c.AbortWithStatus(http.StatusNotFound)
+		return
+	}
+	uid, _ := c.Session().Get("uid").(int64)
+	anonymous := uid == 0
+	if anonymous {
+		var err error
+		if uid, err = publicUserID(); err != nil {
+			log.Warn("Unable to find the public user", "error", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+	}
+	var (
+		status   int
+		redirect string
+		content  io.ReadCloser
+		size     int64
+		info     attachmentContentInfo
+	)
+	err := models.ExecuteInNewEnvironment(uid, func(env models.Environment) {
+		var attachment m.AttachmentSet
+		if anonymous {
+			// The public user has no access to attachments: the requested attachment
+			// only is read as superuser, once it is known to be served anonymously.
+			attachment = h.Attachment().NewSet(env).Sudo().FindServedAttachment(id, attachURL, token, c.ClientIP())
+			if attachment.IsNotEmpty() && token == "" && (!attachment.Public() || attachment.ResField() != "") {
+				status = http.StatusForbidden
+				return
+			}
+		} else {
+			attachment = h.Attachment().NewSet(env).FindServedAttachment(id, attachURL, token, c.ClientIP())
+		}
+		switch {
+		case attachment.IsEmpty():
+			status = http.StatusNotFound
+			return
+		case attachment.Type() == "url":
+			redirect = attachment.URL()
+			return
+		}
+		info = attachmentContentInfo{
+			name:       attachment.Name(),
+			mimeType:   attachment.MimeType(),
+			checkSum:   attachment.CheckSum(),
+			lastUpdate: attachment.LastUpdate().Time,
+			public:     attachment.Public(),
+			download:   c.Query("download") == "true",
+		}
+		if attachmentNotModified(c.Request, info.etag()) {
+			status = http.StatusNotModified
+			return
+		}
+		size = int64(attachment.FileSize())
+		var openErr error
+		content, openErr = attachment.OpenContent()
+		switch {
+		case openErr == ErrAttachmentNotFound:
+			status = http.StatusNotFound
+		case openErr != nil:
+			log.Warn("Unable to open attachment content", "attachment", attachment.ID(), "error", openErr)
+			status = http.StatusInternalServerError
+		}
+	})
+	if err != nil {
+		if content != nil {
+			content.Close()
+		}
+		log.Debug("Attachment access denied", "id", id, "url", attachURL, "uid", uid, "error", err)
+		c.AbortWithStatus(http.StatusForbidden)
+		return
+	}
+	switch {
+	case redirect != "":
+		c.Redirect(http.StatusFound, redirect)
+	case status == http.StatusNotModified:
+		setAttachmentHeaders(c.Writer, info)
+		c.Status(http.StatusNotModified)
+	case status != 0:
+		c.AbortWithStatus(status)
+	default:
+		defer content.Close()
+		// Contents of the database, of the filestore and of S3 storages are seekable
+		if seeker, ok := content.(io.ReadSeeker); ok {
+			serveAttachmentContent(c.Writer, c.Request, seeker, info)
+			return
+		}
+		streamAttachmentContent(c.Writer, c.Request, content, size, info)
+	}
+}
+
+func init() {
+	for _, path := range []string{"/attachment", "/attachment/:id", "/attachment/:id/:filename"} {
+		controllers.Registry.AddController(http.MethodGet, path, ServeAttachment)
+		controllers.Registry.AddController(http.MethodHead, path, ServeAttachment)
+	}
+}
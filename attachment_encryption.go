@@ -0,0 +1,602 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Encrypted files of the filestore have the following layout:
+//
+//	magic (4) | master key id (8) | wrapping nonce (12) | wrapped data key (48) | base nonce (12) | chunk size (4)
+//
+// followed by the content encrypted with AES-GCM in chunks of chunk size bytes.
+// Each chunk is sealed with the data key, a nonce derived from the base nonce and the
+// chunk index, and the header followed by a 'last chunk' flag as additional data, so
+// that chunks cannot be reordered or truncated.
+//
+// The names of encrypted files end with encryptedFileSuffix.
+const (
+	encryptionMagic       = "HXE1"
+	encryptionKeyIDSize   = 8
+	encryptionHeaderSize  = 4 + encryptionKeyIDSize + 12 + 48 + 12 + 4
+	encryptionChunkSize   = 64 << 10
+	encryptionTagOverhead = 16
+)
+
+var (
+	// ErrEncryptionKeyNotFound is returned when an encrypted file has been encrypted with
+	// a master key that is not configured.
+	ErrEncryptionKeyNotFound = errors.New("encryption master key of the file is not configured")
+	// ErrEncryptedFileCorrupted is returned when an encrypted file has been tampered with or truncated.
+	ErrEncryptedFileCorrupted = errors.New("encrypted file is corrupted")
+)
+
+// filestoreKeys are the master keys of the filestore encryption.
+type filestoreKeys struct {
+	// current is the key used to encrypt new files. It is nil if encryption is disabled.
+	current []byte
+	// all keys, including current, by key ID
+	all map[string][]byte
+}
+
+// encryptionKeyID returns the identifier of the given master key
+func encryptionKeyID(key []byte) string {
+	sum := sha256.Sum256(key)
+	return string(sum[:encryptionKeyIDSize])
+}
+
+// getFilestoreKeys returns the master keys of the filestore encryption from the following keys
+// of the Hexya configuration:
+//
+// - Attachment.Encryption.MasterKey is the base64 encoded 32 bytes key used to encrypt new files.
+// Files are not encrypted if it is not set.
+//
+// - Attachment.Encryption.OldMasterKeys is the list of base64 encoded keys that are only used
+// to decrypt files. It should hold former master keys until RotateEncryptionKeys is executed.
+func getFilestoreKeys() (filestoreKeys, error) {
+	res := filestoreKeys{all: make(map[string][]byte)}
+	decode := func(encoded string) ([]byte, error) {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption master key: %s", err)
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("invalid encryption master key: expected 32 bytes, got %d", len(key))
+		}
+		res.all[encryptionKeyID(key)] = key
+		return key, nil
+	}
+	for _, encoded := range viper.GetStringSlice("Attachment.Encryption.OldMasterKeys") {
+		if _, err := decode(encoded); err != nil {
+			return res, err
+		}
+	}
+	if encoded := viper.GetString("Attachment.Encryption.MasterKey"); encoded != "" {
+		key, err := decode(encoded)
+		if err != nil {
+			return res, err
+		}
+		res.current = key
+	}
+	return res, nil
+}
+
+// newGCM returns an AES-GCM AEAD with the given key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// chunkNonce returns the nonce of the chunk with the given index
+func chunkNonce(baseNonce []byte, index uint64) []byte {
+	nonce := make([]byte, len(baseNonce))
+	copy(nonce, baseNonce)
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], index)
+	for i := range counter {
+		nonce[len(nonce)-8+i] ^= counter[i]
+	}
+	return nonce
+}
+
+// chunkAdditionalData returns the additional data of a chunk
+func chunkAdditionalData(header []byte, last bool) []byte {
+	ad := make([]byte, len(header)+1)
+	copy(ad, header)
+	if last {
+		ad[len(header)] = 1
+	}
+	return ad
+}
+
+// encryptingWriter encrypts the data written to it into w. It must be closed to write the last chunk.
+type encryptingWriter struct {
+	w         io.Writer
+	aead      cipher.AEAD
+	header    []byte
+	baseNonce []byte
+	buf       []byte
+	index     uint64
+}
+
+// newEncryptingWriter writes the header of a new encrypted file into w with a new data key
+// wrapped by the given master key, and returns a writer that encrypts its data into w.
+func newEncryptingWriter(w io.Writer, masterKey []byte) (*encryptingWriter, error) {
+	dataKey := make([]byte, 32)
+	wrapNonce := make([]byte, 12)
+	baseNonce := make([]byte, 12)
+	for _, b := range [][]byte{dataKey, wrapNonce, baseNonce} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+	}
+	masterAEAD, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, encryptionHeaderSize)
+	header = append(header, encryptionMagic...)
+	header = append(header, encryptionKeyID(masterKey)...)
+	header = append(header, wrapNonce...)
+	header = masterAEAD.Seal(header, wrapNonce, dataKey, []byte(encryptionMagic))
+	header = append(header, baseNonce...)
+	var chunkSize [4]byte
+	binary.BigEndian.PutUint32(chunkSize[:], encryptionChunkSize)
+	header = append(header, chunkSize[:]...)
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = w.Write(header); err != nil {
+		return nil, err
+	}
+	return &encryptingWriter{
+		w:         w,
+		aead:      aead,
+		header:    header,
+		baseNonce: baseNonce,
+		buf:       make([]byte, 0, encryptionChunkSize),
+	}, nil
+}
+
+// Write method of the encryptingWriter
+func (ew *encryptingWriter) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		if len(ew.buf) == encryptionChunkSize {
+			// The chunk is only written now that we know it is not the last one
+			if err := ew.flush(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+// flush encrypts and writes the buffered chunk
+func (ew *encryptingWriter) flush(last bool) error {
+	sealed := ew.aead.Seal(nil, chunkNonce(ew.baseNonce, ew.index), ew.buf, chunkAdditionalData(ew.header, last))
+	ew.index++
+	ew.buf = ew.buf[:0]
+	_, err := ew.w.Write(sealed)
+	return err
+}
+
+// Close writes the last chunk. It does not close the underlying writer.
+func (ew *encryptingWriter) Close() error {
+	return ew.flush(true)
+}
+
+// decryptingReader decrypts an encrypted file. Since chunks have a fixed size, it can
+// read the content at any offset by decrypting only the chunks that hold it.
+type decryptingReader struct {
+	r          io.ReaderAt
+	closer     io.Closer
+	aead       cipher.AEAD
+	header     []byte
+	baseNonce  []byte
+	chunkSize  int64
+	chunks     int64
+	fileSize   int64
+	size       int64
+	offset     int64
+	chunkIndex int64
+	chunk      []byte
+}
+
+var _ io.ReadSeeker = new(decryptingReader)
+var _ io.ReaderAt = new(decryptingReader)
+
+// newDecryptingReader reads the header of the encrypted file of the given size read from r
+// and returns a reader of its decrypted content. Closing it closes closer if it is not nil.
+func newDecryptingReader(r io.ReaderAt, fileSize int64, closer io.Closer, keys filestoreKeys) (*decryptingReader, error) {
+	header := make([]byte, encryptionHeaderSize)
+	if _, err := r.ReadAt(header, 0); err != nil {
+		return nil, ErrEncryptedFileCorrupted
+	}
+	if string(header[:4]) != encryptionMagic {
+		return nil, ErrEncryptedFileCorrupted
+	}
+	masterKey, ok := keys.all[string(header[4:4+encryptionKeyIDSize])]
+	if !ok {
+		return nil, ErrEncryptionKeyNotFound
+	}
+	masterAEAD, err := newGCM(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	wrapNonce := header[12:24]
+	dataKey, err := masterAEAD.Open(nil, wrapNonce, header[24:72], []byte(encryptionMagic))
+	if err != nil {
+		return nil, ErrEncryptedFileCorrupted
+	}
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	chunkSize := int64(binary.BigEndian.Uint32(header[84:88]))
+	size, chunks, err := encryptedContentSize(fileSize, chunkSize)
+	if err != nil {
+		return nil, err
+	}
+	return &decryptingReader{
+		r:          r,
+		closer:     closer,
+		aead:       aead,
+		header:     header,
+		baseNonce:  header[72:84],
+		chunkSize:  chunkSize,
+		chunks:     chunks,
+		fileSize:   fileSize,
+		size:       size,
+		chunkIndex: -1,
+	}, nil
+}
+
+// encryptedContentSize returns the size of the decrypted content of an encrypted file
+// of the given size and chunk size, and its number of chunks. There is always at least
+// one chunk, which is empty for empty contents.
+func encryptedContentSize(fileSize, chunkSize int64) (int64, int64, error) {
+	payload := fileSize - encryptionHeaderSize
+	sealedChunkSize := chunkSize + encryptionTagOverhead
+	if chunkSize <= 0 || payload < encryptionTagOverhead {
+		return 0, 0, ErrEncryptedFileCorrupted
+	}
+	chunks := (payload + sealedChunkSize - 1) / sealedChunkSize
+	if payload-(chunks-1)*sealedChunkSize < encryptionTagOverhead {
+		return 0, 0, ErrEncryptedFileCorrupted
+	}
+	return payload - chunks*encryptionTagOverhead, chunks, nil
+}
+
+// loadChunk reads and decrypts the chunk with the given index
+func (dr *decryptingReader) loadChunk(index int64) error {
+	if index == dr.chunkIndex {
+		return nil
+	}
+	sealedChunkSize := dr.chunkSize + encryptionTagOverhead
+	start := encryptionHeaderSize + index*sealedChunkSize
+	end := start + sealedChunkSize
+	if end > dr.fileSize {
+		end = dr.fileSize
+	}
+	sealed := make([]byte, end-start)
+	if _, err := dr.r.ReadAt(sealed, start); err != nil {
+		return ErrEncryptedFileCorrupted
+	}
+	last := index == dr.chunks-1
+	plain, err := dr.aead.Open(sealed[:0], chunkNonce(dr.baseNonce, uint64(index)), sealed, chunkAdditionalData(dr.header, last))
+	if err != nil {
+		return ErrEncryptedFileCorrupted
+	}
+	dr.chunkIndex = index
+	dr.chunk = plain
+	return nil
+}
+
+// ReadAt method of the decryptingReader
+func (dr *decryptingReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	var n int
+	for n < len(p) {
+		if off >= dr.size {
+			return n, io.EOF
+		}
+		index := off / dr.chunkSize
+		if err := dr.loadChunk(index); err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], dr.chunk[off-index*dr.chunkSize:])
+		n += copied
+		off += int64(copied)
+	}
+	return n, nil
+}
+
+// Read method of the decryptingReader
+func (dr *decryptingReader) Read(p []byte) (int, error) {
+	if dr.offset >= dr.size {
+		// Check the last chunk so that truncated files are detected
+		if err := dr.loadChunk(dr.chunks - 1); err != nil {
+			return 0, err
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > dr.size-dr.offset {
+		p = p[:dr.size-dr.offset]
+	}
+	n, err := dr.ReadAt(p, dr.offset)
+	dr.offset += int64(n)
+	if err == io.EOF {
+		err = nil
+	}
+	return n, err
+}
+
+// Seek method of the decryptingReader
+func (dr *decryptingReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += dr.offset
+	case io.SeekEnd:
+		offset += dr.size
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	dr.offset = offset
+	return offset, nil
+}
+
+// Close method of the decryptingReader
+func (dr *decryptingReader) Close() error {
+	if dr.closer == nil {
+		return nil
+	}
+	return dr.closer.Close()
+}
+
+// encryptedFileSuffix is appended to the names of the encrypted files of the filestore.
+// The encryption state is given by the file name and not by the content, since the content
+// of plain files is chosen by users and may look like an encrypted file.
+const encryptedFileSuffix = ".enc"
+
+// isEncryptedPath returns true if the file of the filestore with the given path is encrypted
+func isEncryptedPath(path string) bool {
+	return strings.HasSuffix(path, encryptedFileSuffix)
+}
+
+// openFilestoreFile opens the file of the filestore with the given full path
+// and returns a reader of its decrypted content. The returned reader implements
+// io.Seeker and io.ReaderAt.
+func openFilestoreFile(fullPath string) (io.ReadCloser, error) {
+	f, err := os.Open(fullPath)
+	if err != nil || !isEncryptedPath(fullPath) {
+		return f, err
+	}
+	keys, err := getFilestoreKeys()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	fInfo, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	dr, err := newDecryptingReader(f, fInfo.Size(), f, keys)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return dr, nil
+}
+
+// filestoreFileSize returns the size of the decrypted content of the file of
+// the filestore with the given full path.
+func filestoreFileSize(fullPath string) (int64, error) {
+	f, err := os.Open(fullPath)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	fInfo, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if !isEncryptedPath(fullPath) {
+		return fInfo.Size(), nil
+	}
+	header := make([]byte, encryptionHeaderSize)
+	if _, err = f.ReadAt(header, 0); err != nil {
+		return 0, ErrEncryptedFileCorrupted
+	}
+	size, _, err := encryptedContentSize(fInfo.Size(), int64(binary.BigEndian.Uint32(header[84:88])))
+	return size, err
+}
+
+// writeFilestoreFile writes the content read from r into the given file of the filestore,
+// encrypting it with the current master key of keys if encryption is enabled.
+func writeFilestoreFile(f *os.File, r io.Reader, keys filestoreKeys) error {
+	if keys.current == nil {
+		_, err := io.Copy(f, r)
+		return err
+	}
+	ew, err := newEncryptingWriter(f, keys.current)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(ew, r); err != nil {
+		return err
+	}
+	return ew.Close()
+}
+
+// rotateFilestoreFile re-encrypts the given file of the filestore with the current master key.
+// Plain files are encrypted if encryption is enabled and encrypted files are decrypted if it is
+// disabled, which changes their name. It returns the full path of the new file, or an empty
+// string if the file is already encrypted with the current master key.
+func rotateFilestoreFile(fullPath string, keys filestoreKeys) (string, error) {
+	target := fullPath
+	switch encrypted := isEncryptedPath(fullPath); {
+	case !encrypted && keys.current == nil:
+		return "", nil
+	case !encrypted:
+		target = fullPath + encryptedFileSuffix
+	case keys.current == nil:
+		target = strings.TrimSuffix(fullPath, encryptedFileSuffix)
+	default:
+		f, err := os.Open(fullPath)
+		if err != nil {
+			return "", err
+		}
+		header := make([]byte, 4+encryptionKeyIDSize)
+		n, _ := f.ReadAt(header, 0)
+		f.Close()
+		if n == len(header) && string(header[4:]) == encryptionKeyID(keys.current) {
+			return "", nil
+		}
+	}
+	if target != fullPath {
+		if _, err := os.Stat(target); err == nil {
+			// The content has already been stored in the target state
+			return target, nil
+		}
+	}
+	r, err := openFilestoreFile(fullPath)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fullPath), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpFile.Name())
+	if err = writeFilestoreFile(tmpFile, r, keys); err != nil {
+		tmpFile.Close()
+		return "", err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return "", err
+	}
+	if err = os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return "", err
+	}
+	return target, os.Rename(tmpFile.Name(), target)
+}
+
+// readSeekerAt is a reader that can read at random positions
+type readSeekerAt interface {
+	io.ReadSeeker
+	io.ReaderAt
+}
+
+// A spoolFile is a temporary file to which contents are written before being processed.
+//
+// If filestore encryption is enabled, the content is encrypted with a random key that is
+// only kept in memory, so that plain contents are never written to the disk.
+type spoolFile struct {
+	file   *os.File
+	w      io.Writer
+	ew     *encryptingWriter
+	key    []byte
+	reader readSeekerAt
+}
+
+// newSpoolFile creates a new spool file in the given directory
+func newSpoolFile(dir string) (*spoolFile, error) {
+	keys, err := getFilestoreKeys()
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(dir, "content-")
+	if err != nil {
+		return nil, err
+	}
+	sf := &spoolFile{file: f, w: f}
+	if keys.current == nil {
+		return sf, nil
+	}
+	sf.key = make([]byte, 32)
+	if _, err = io.ReadFull(rand.Reader, sf.key); err != nil {
+		sf.Remove()
+		return nil, err
+	}
+	if sf.ew, err = newEncryptingWriter(f, sf.key); err != nil {
+		sf.Remove()
+		return nil, err
+	}
+	sf.w = sf.ew
+	return sf, nil
+}
+
+// Write method of the spoolFile
+func (sf *spoolFile) Write(p []byte) (int, error) {
+	return sf.w.Write(p)
+}
+
+// Rewind ends the writing of the content and returns a reader of the
+// plain content positioned at its beginning.
+func (sf *spoolFile) Rewind() (readSeekerAt, error) {
+	if sf.reader != nil {
+		_, err := sf.reader.Seek(0, io.SeekStart)
+		return sf.reader, err
+	}
+	if sf.ew == nil {
+		if _, err := sf.file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		sf.reader = sf.file
+		return sf.reader, nil
+	}
+	if err := sf.ew.Close(); err != nil {
+		return nil, err
+	}
+	fInfo, err := sf.file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	keys := filestoreKeys{all: map[string][]byte{encryptionKeyID(sf.key): sf.key}}
+	if sf.reader, err = newDecryptingReader(sf.file, fInfo.Size(), nil, keys); err != nil {
+		return nil, err
+	}
+	return sf.reader, nil
+}
+
+// Remove closes and deletes the spool file
+func (sf *spoolFile) Remove() {
+	sf.file.Close()
+	os.Remove(sf.file.Name())
+}
@@ -0,0 +1,530 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
+	"encoding/xml"
+	"io"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf16"
+)
+
+// A ContentExtractor returns the text of a document of the given size for indexing.
+type ContentExtractor func(r io.ReaderAt, size int64) (string, error)
+
+var contentExtractors = struct {
+	sync.RWMutex
+	extractors map[string]ContentExtractor
+}{
+	extractors: make(map[string]ContentExtractor),
+}
+
+// RegisterContentExtractor registers the given extractor for attachments of the given MIME type.
+// Registering an extractor for an existing MIME type replaces it.
+func RegisterContentExtractor(mimeType string, extractor ContentExtractor) {
+	contentExtractors.Lock()
+	defer contentExtractors.Unlock()
+	contentExtractors.extractors[baseMimeType(mimeType)] = extractor
+}
+
+// GetContentExtractor returns the extractor registered for the given MIME type
+func GetContentExtractor(mimeType string) (ContentExtractor, bool) {
+	contentExtractors.RLock()
+	defer contentExtractors.RUnlock()
+	extractor, ok := contentExtractors.extractors[baseMimeType(mimeType)]
+	return extractor, ok
+}
+
+// baseMimeType returns the given MIME type without its parameters
+func baseMimeType(mimeType string) string {
+	return strings.ToLower(strings.TrimSpace(strings.Split(mimeType, ";")[0]))
+}
+
+// canExtractContent returns true if the content of documents of the given MIME
+// type may be extracted by a registered extractor.
+func canExtractContent(mimeType string) bool {
+	if _, ok := GetContentExtractor(mimeType); ok {
+		return true
+	}
+	return baseMimeType(mimeType) == "application/zip"
+}
+
+// Office document MIME types
+const (
+	mimeTypeODT  = "application/vnd.oasis.opendocument.text"
+	mimeTypeODS  = "application/vnd.oasis.opendocument.spreadsheet"
+	mimeTypeODP  = "application/vnd.oasis.opendocument.presentation"
+	mimeTypeDOCX = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	mimeTypeXLSX = "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+)
+
+// zipMimeType returns the MIME type of the office document stored in the given zip
+// archive, or "application/zip" if it is not a known office document.
+//
+// This is needed because http.DetectContentType reports all of them as zip archives.
+func zipMimeType(r io.ReaderAt, size int64) string {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "application/zip"
+	}
+	for _, f := range archive.File {
+		switch f.Name {
+		case "mimetype":
+			// OpenDocument
+			data, err := readZipFile(f)
+			if err == nil {
+				return strings.TrimSpace(string(data))
+			}
+		case "word/document.xml":
+			return mimeTypeDOCX
+		case "xl/workbook.xml":
+			return mimeTypeXLSX
+		}
+	}
+	return "application/zip"
+}
+
+// readZipFile returns the content of the given file of a zip archive,
+// truncated to attachmentIndexMaxSize bytes.
+func readZipFile(f *zip.File) ([]byte, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return ioutil.ReadAll(io.LimitReader(rc, attachmentIndexMaxSize))
+}
+
+// extractMaxDecompressedSize is the maximum number of bytes that are decompressed
+// when extracting the text of a document, to protect against decompression bombs.
+const extractMaxDecompressedSize = 4 * attachmentIndexMaxSize
+
+// A decompressionBudget counts the bytes decompressed while extracting the text of a document.
+type decompressionBudget struct {
+	remaining int64
+}
+
+// newDecompressionBudget returns a budget of extractMaxDecompressedSize bytes
+func newDecompressionBudget() *decompressionBudget {
+	return &decompressionBudget{remaining: extractMaxDecompressedSize}
+}
+
+// exhausted returns true if no more bytes can be decompressed
+func (db *decompressionBudget) exhausted() bool {
+	return db.remaining <= 0
+}
+
+// reader returns a reader of the decompressed stream r that reads at most attachmentIndexMaxSize
+// bytes and the remaining bytes of this budget.
+func (db *decompressionBudget) reader(r io.Reader) io.Reader {
+	limit := db.remaining
+	if limit > attachmentIndexMaxSize {
+		limit = attachmentIndexMaxSize
+	}
+	return &budgetReader{r: io.LimitReader(r, limit), budget: db}
+}
+
+// budgetReader is a reader that decreases its budget of the bytes it reads
+type budgetReader struct {
+	r      io.Reader
+	budget *decompressionBudget
+}
+
+// Read method of the budgetReader
+func (br *budgetReader) Read(p []byte) (int, error) {
+	n, err := br.r.Read(p)
+	br.budget.remaining -= int64(n)
+	return n, err
+}
+
+// xmlTextElements describes how to get the text of an XML document.
+// Elements are given by their local name.
+type xmlTextElements struct {
+	// Text is the set of elements whose character data is extracted. All character data is extracted if nil.
+	Text map[string]bool
+	// Lines is the set of elements after which a new line is inserted
+	Lines map[string]bool
+	// Spaces is the set of elements which are replaced by a space
+	Spaces map[string]bool
+}
+
+// xmlText returns the text of the XML document read from r.
+// It stops reading when the text reaches limit bytes.
+func xmlText(r io.Reader, elements xmlTextElements, limit int) (string, error) {
+	var (
+		res    strings.Builder
+		inText int
+	)
+	decoder := xml.NewDecoder(r)
+	for res.Len() < limit {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res.String(), err
+		}
+		switch tok := token.(type) {
+		case xml.StartElement:
+			if elements.Text[tok.Name.Local] {
+				inText++
+			}
+			if elements.Spaces[tok.Name.Local] {
+				res.WriteString(" ")
+			}
+		case xml.EndElement:
+			if elements.Text[tok.Name.Local] {
+				inText--
+			}
+			if elements.Lines[tok.Name.Local] {
+				res.WriteString("\n")
+			}
+		case xml.CharData:
+			if elements.Text == nil || inText > 0 {
+				res.Write(tok)
+			}
+		}
+	}
+	return res.String(), nil
+}
+
+// zipXMLText returns the concatenated text of the files of the given zip archive whose name match the given regexp.
+// Extraction stops when the text reaches attachmentIndexMaxSize bytes or when too much data has been decompressed.
+func zipXMLText(r io.ReaderAt, size int64, files *regexp.Regexp, elements xmlTextElements) (string, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return "", err
+	}
+	var res strings.Builder
+	budget := newDecompressionBudget()
+	for _, f := range archive.File {
+		if res.Len() >= attachmentIndexMaxSize || budget.exhausted() {
+			break
+		}
+		if !files.MatchString(f.Name) {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return res.String(), err
+		}
+		text, err := xmlText(budget.reader(rc), elements, attachmentIndexMaxSize-res.Len())
+		rc.Close()
+		res.WriteString(text)
+		if err != nil {
+			return res.String(), err
+		}
+	}
+	return res.String(), nil
+}
+
+// ExtractOpenDocumentText returns the text of an OpenDocument text, spreadsheet or presentation
+func ExtractOpenDocumentText(r io.ReaderAt, size int64) (string, error) {
+	return zipXMLText(r, size, regexp.MustCompile(`^content\.xml$`), xmlTextElements{
+		Lines:  map[string]bool{"p": true, "h": true, "line-break": true, "table-row": true},
+		Spaces: map[string]bool{"s": true, "tab": true, "table-cell": true},
+	})
+}
+
+// ExtractDOCXText returns the text of an Office Open XML word processing document
+func ExtractDOCXText(r io.ReaderAt, size int64) (string, error) {
+	return zipXMLText(r, size, regexp.MustCompile(`^word/(document|header\d*|footer\d*|footnotes|endnotes)\.xml$`), xmlTextElements{
+		Text:   map[string]bool{"t": true},
+		Lines:  map[string]bool{"p": true, "br": true},
+		Spaces: map[string]bool{"tab": true},
+	})
+}
+
+// ExtractXLSXText returns the text of an Office Open XML spreadsheet.
+// Only strings are extracted, numbers and formulas are ignored.
+func ExtractXLSXText(r io.ReaderAt, size int64) (string, error) {
+	return zipXMLText(r, size, regexp.MustCompile(`^xl/(sharedStrings|worksheets/sheet\d+)\.xml$`), xmlTextElements{
+		Text:  map[string]bool{"t": true},
+		Lines: map[string]bool{"si": true, "is": true},
+	})
+}
+
+var (
+	pdfStreamRegex   = regexp.MustCompile(`stream\r?\n`)
+	pdfEndStream     = []byte("endstream")
+	pdfTextOperators = map[string]string{"Td": "\n", "TD": "\n", "T*": "\n", "'": "\n", "\"": "\n", "ET": "\n"}
+)
+
+const (
+	// pdfReadSize is the size of the chunks read from PDF files
+	pdfReadSize = 64 << 10
+	// pdfDictMaxSize is the maximum size of the stream dictionaries that are looked up
+	pdfDictMaxSize = 4 << 10
+)
+
+// ExtractPDFText returns the text of a PDF document.
+//
+// This is a simple extractor that reads the text showing operators of the uncompressed and
+// FlateDecode compressed content streams. Text written with fonts that use a custom encoding
+// without Unicode mapping cannot be extracted.
+//
+// The document is scanned sequentially, so that only the stream being read is kept in memory.
+// Streams larger than attachmentIndexMaxSize are skipped.
+func ExtractPDFText(r io.ReaderAt, size int64) (string, error) {
+	var (
+		res      strings.Builder
+		buf      []byte
+		dict     []byte
+		inStream bool
+		skip     bool
+		scanned  int
+	)
+	budget := newDecompressionBudget()
+	sr := io.NewSectionReader(r, 0, size)
+	chunk := make([]byte, pdfReadSize)
+	for res.Len() < attachmentIndexMaxSize && !budget.exhausted() {
+		n, err := sr.Read(chunk)
+		if err != nil && err != io.EOF {
+			return res.String(), err
+		}
+		buf = append(buf, chunk[:n]...)
+		for {
+			if !inStream {
+				dictStart, dictEnd, contentStart := pdfStreamStart(buf)
+				if contentStart < 0 {
+					if len(buf) > pdfDictMaxSize {
+						buf = append([]byte(nil), buf[len(buf)-pdfDictMaxSize:]...)
+					}
+					break
+				}
+				dict = append(dict[:0], buf[dictStart:dictEnd]...)
+				buf = buf[contentStart:]
+				inStream, skip, scanned = true, false, 0
+			}
+			end := bytes.Index(buf[scanned:], pdfEndStream)
+			if end < 0 {
+				// Keep the bytes that may be the beginning of the next endstream keyword
+				scanned = len(buf) - len(pdfEndStream) + 1
+				if scanned < 0 {
+					scanned = 0
+				}
+				if len(buf) > attachmentIndexMaxSize {
+					skip = true
+				}
+				if skip {
+					buf = append([]byte(nil), buf[scanned:]...)
+					scanned = 0
+				}
+				break
+			}
+			end += scanned
+			if !skip {
+				res.WriteString(pdfStreamText(dict, buf[:end], budget))
+			}
+			buf = buf[end+len(pdfEndStream):]
+			inStream = false
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	return res.String(), nil
+}
+
+// pdfStreamStart returns the start and the end of the dictionary of the first
+// stream of data, and the start of its content. contentStart is -1 if there is none.
+func pdfStreamStart(data []byte) (dictStart, dictEnd, contentStart int) {
+	for _, loc := range pdfStreamRegex.FindAllIndex(data, -1) {
+		if loc[0] > 0 && data[loc[0]-1] == 'd' {
+			// endstream
+			continue
+		}
+		dictStart = bytes.LastIndex(data[:loc[0]], []byte(" obj"))
+		if dictStart < 0 {
+			continue
+		}
+		return dictStart, loc[0], loc[1]
+	}
+	return 0, 0, -1
+}
+
+// pdfStreamText returns the text shown by the PDF stream with the given dictionary and content.
+// Compressed contents are decompressed within the given budget.
+func pdfStreamText(dict, content []byte, budget *decompressionBudget) string {
+	switch {
+	case bytes.Contains(dict, []byte("/Image")), bytes.Contains(dict, []byte("/XRef")):
+		return ""
+	case bytes.Contains(dict, []byte("/FlateDecode")):
+		zr, err := zlib.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return ""
+		}
+		// Keep what could be decompressed of truncated streams
+		content, _ = ioutil.ReadAll(budget.reader(zr))
+	case bytes.Contains(dict, []byte("/Filter")):
+		// Other filters are not supported
+		return ""
+	}
+	if !bytes.Contains(content, []byte("BT")) {
+		return ""
+	}
+	return pdfContentText(content)
+}
+
+// pdfContentText returns the text shown by the given PDF content stream
+func pdfContentText(content []byte) string {
+	var (
+		res    strings.Builder
+		inText bool
+	)
+	for i := 0; i < len(content); i++ {
+		switch c := content[i]; {
+		case c == '(' && inText:
+			var s []byte
+			s, i = pdfLiteralString(content, i)
+			res.WriteString(pdfDecodeString(s))
+		case c == '<' && inText && i+1 < len(content) && content[i+1] != '<':
+			end := bytes.IndexByte(content[i:], '>')
+			if end < 0 {
+				return res.String()
+			}
+			res.WriteString(pdfDecodeString(pdfHexString(content[i+1 : i+end])))
+			i += end
+		case c == '-' && inText:
+			// Large negative offsets in TJ arrays separate words
+			j := i + 1
+			for j < len(content) && (content[j] >= '0' && content[j] <= '9' || content[j] == '.') {
+				j++
+			}
+			if j-i > 3 {
+				res.WriteString(" ")
+			}
+			i = j - 1
+		case c >= 'A' && c <= 'Z' || c == '\'' || c == '"' || c >= 'a' && c <= 'z' || c == '*':
+			j := i
+			for j < len(content) && (content[j] >= 'A' && content[j] <= 'Z' || content[j] >= 'a' && content[j] <= 'z' ||
+				content[j] == '*' || content[j] == '\'' || content[j] == '"') {
+				j++
+			}
+			op := string(content[i:j])
+			switch op {
+			case "BT":
+				inText = true
+			case "ET":
+				inText = false
+			}
+			if inText || op == "ET" {
+				res.WriteString(pdfTextOperators[op])
+			}
+			i = j - 1
+		}
+	}
+	return res.String()
+}
+
+// pdfLiteralString returns the unescaped literal string starting at the opening
+// parenthesis at index start in data, and the index of its closing parenthesis.
+func pdfLiteralString(data []byte, start int) ([]byte, int) {
+	var (
+		res   []byte
+		depth int
+	)
+	for i := start + 1; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return res, i
+			}
+			depth--
+		case '\\':
+			i++
+			if i >= len(data) {
+				return res, i
+			}
+			switch esc := data[i]; esc {
+			case 'n':
+				res = append(res, '\n')
+			case 'r':
+				res = append(res, '\r')
+			case 't':
+				res = append(res, '\t')
+			case 'b', 'f':
+			case '\r', '\n':
+				// Line continuation
+			default:
+				if esc >= '0' && esc <= '7' {
+					var val byte
+					j := i
+					for ; j < len(data) && j < i+3 && data[j] >= '0' && data[j] <= '7'; j++ {
+						val = val*8 + data[j] - '0'
+					}
+					res = append(res, val)
+					i = j - 1
+					continue
+				}
+				res = append(res, esc)
+			}
+			continue
+		}
+		res = append(res, c)
+	}
+	return res, len(data)
+}
+
+// pdfHexString decodes the given hexadecimal string, ignoring white spaces
+func pdfHexString(data []byte) []byte {
+	var digits []byte
+	for _, c := range data {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = append(digits, c-'0')
+		case c >= 'a' && c <= 'f':
+			digits = append(digits, c-'a'+10)
+		case c >= 'A' && c <= 'F':
+			digits = append(digits, c-'A'+10)
+		}
+	}
+	if len(digits)%2 == 1 {
+		digits = append(digits, 0)
+	}
+	res := make([]byte, len(digits)/2)
+	for i := range res {
+		res[i] = digits[2*i]<<4 | digits[2*i+1]
+	}
+	return res
+}
+
+// pdfDecodeString returns the given PDF string as UTF-8. Strings are either UTF-16BE with
+// a byte order mark or in a single byte encoding that is approximated by Latin-1.
+// Strings with non printable characters, that use a font specific encoding, are dropped.
+func pdfDecodeString(s []byte) string {
+	if len(s) >= 2 && s[0] == 0xFE && s[1] == 0xFF {
+		u16 := make([]uint16, 0, len(s)/2)
+		for i := 2; i+1 < len(s); i += 2 {
+			u16 = append(u16, uint16(s[i])<<8|uint16(s[i+1]))
+		}
+		return string(utf16.Decode(u16))
+	}
+	runes := make([]rune, len(s))
+	for i, c := range s {
+		if c < 0x20 && c != '\n' && c != '\r' && c != '\t' {
+			return ""
+		}
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+func init() {
+	RegisterContentExtractor("application/pdf", ExtractPDFText)
+	RegisterContentExtractor(mimeTypeODT, ExtractOpenDocumentText)
+	RegisterContentExtractor(mimeTypeODS, ExtractOpenDocumentText)
+	RegisterContentExtractor(mimeTypeODP, ExtractOpenDocumentText)
+	RegisterContentExtractor(mimeTypeDOCX, ExtractDOCXText)
+	RegisterContentExtractor(mimeTypeXLSX, ExtractXLSXText)
+}
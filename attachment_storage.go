@@ -0,0 +1,583 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/spf13/viper"
+)
+
+// ErrAttachmentNotFound is returned by storage backends when the content of an attachment does not exist
+var ErrAttachmentNotFound = errors.New("attachment content not found")
+
+// An AttachmentStorage is a backend in which the content of attachments is stored.
+//
+// Backends are registered with RegisterAttachmentStorage and the backend used for
+// new content is selected by the 'attachment.location' configuration parameter.
+// Backends other than "db" and "file" store a StoreFname of the form "name:key"
+// on the attachments so that content can be read whatever the current location.
+type AttachmentStorage interface {
+	// Write stores the size bytes read from r whose SHA1 checksum is given and returns
+	// the values to set on the attachment to reference it.
+	Write(rs m.AttachmentSet, r io.Reader, size int64, checksum string) (m.AttachmentData, error)
+	// Open returns a reader of the content of the given attachment. It must be closed after use.
+	Open(rs m.AttachmentSet) (io.ReadCloser, error)
+	// Size returns the size in bytes of the content of the given attachment.
+	Size(rs m.AttachmentSet) (int64, error)
+	// Delete removes the content stored under the given StoreFname.
+	// It is called by the garbage collector once storeFname is not referenced anymore.
+	Delete(rs m.AttachmentSet, storeFname string) error
+}
+
+var attachmentStorages = struct {
+	sync.RWMutex
+	backends map[string]AttachmentStorage
+}{
+	backends: make(map[string]AttachmentStorage),
+}
+
+// RegisterAttachmentStorage registers the given storage backend under the given name.
+// Registering a backend with an existing name replaces it.
+func RegisterAttachmentStorage(name string, storage AttachmentStorage) {
+	attachmentStorages.Lock()
+	defer attachmentStorages.Unlock()
+	attachmentStorages.backends[name] = storage
+}
+
+// GetAttachmentStorage returns the storage backend registered with the given name
+func GetAttachmentStorage(name string) (AttachmentStorage, bool) {
+	attachmentStorages.RLock()
+	defer attachmentStorages.RUnlock()
+	storage, ok := attachmentStorages.backends[name]
+	return storage, ok
+}
+
+// attachmentStorageName returns the name of the backend holding the content referenced by the
+// given StoreFname and DBDatas, or an empty string if there is no content.
+func attachmentStorageName(storeFname, dbDatas string) string {
+	if storeFname == "" {
+		if dbDatas == "" {
+			return ""
+		}
+		return "db"
+	}
+	if i := strings.Index(storeFname, ":"); i > 0 {
+		if _, ok := GetAttachmentStorage(storeFname[:i]); ok {
+			return storeFname[:i]
+		}
+	}
+	return "file"
+}
+
+// storageKey returns the key of the given StoreFname in a keyed backend
+func storageKey(storeFname string) string {
+	if i := strings.Index(storeFname, ":"); i > 0 {
+		return storeFname[i+1:]
+	}
+	return storeFname
+}
+
+// dbStorage stores the content of attachments in the DBDatas field
+type dbStorage struct{}
+
+var _ AttachmentStorage = dbStorage{}
+
+// Write method of the dbStorage
+func (dbStorage) Write(_ m.AttachmentSet, r io.Reader, size int64, _ string) (m.AttachmentData, error) {
+	var buf strings.Builder
+	buf.Grow(base64.StdEncoding.EncodedLen(int(size)))
+	encoder := base64.NewEncoder(base64.StdEncoding, &buf)
+	if _, err := io.Copy(encoder, r); err != nil {
+		return nil, err
+	}
+	encoder.Close()
+	return h.Attachment().NewData().
+		SetDBDatas(buf.String()).
+		SetStoreFname(""), nil
+}
+
+// bytesContent is an in-memory content that can be read at random positions
+type bytesContent struct {
+	*bytes.Reader
+}
+
+// Close method of the bytesContent
+func (bytesContent) Close() error {
+	return nil
+}
+
+// Open method of the dbStorage
+//
+// Contents stored in the database are already loaded in memory, so they are
+// decoded in memory to be readable at random positions.
+func (dbStorage) Open(rs m.AttachmentSet) (io.ReadCloser, error) {
+	data, err := base64.StdEncoding.DecodeString(rs.DBDatas())
+	if err != nil {
+		return nil, err
+	}
+	return bytesContent{Reader: bytes.NewReader(data)}, nil
+}
+
+// Size method of the dbStorage
+func (dbStorage) Size(rs m.AttachmentSet) (int64, error) {
+	return int64(base64.StdEncoding.DecodedLen(len(rs.DBDatas())) - strings.Count(rs.DBDatas(), "=")), nil
+}
+
+// Delete method of the dbStorage
+func (dbStorage) Delete(_ m.AttachmentSet, _ string) error {
+	return nil
+}
+
+// fileStorage stores the content of attachments in files under FileStore()
+type fileStorage struct{}
+
+var _ AttachmentStorage = fileStorage{}
+
+// Write method of the fileStorage
+//
+// If r is a file and encryption is disabled, it is moved into the filestore when possible
+// instead of being copied. Encrypted files are stored with encryptedFileSuffix.
+func (fileStorage) Write(rs m.AttachmentSet, r io.Reader, _ int64, checksum string) (m.AttachmentData, error) {
+	keys, err := getFilestoreKeys()
+	if err != nil {
+		return nil, err
+	}
+	fName, fullPath := rs.GetPath(checksum)
+	if keys.current != nil {
+		fName += encryptedFileSuffix
+		fullPath += encryptedFileSuffix
+	}
+	values := h.Attachment().NewData().SetStoreFname(fName).SetDBDatas("")
+	if _, err = os.Stat(fullPath); err == nil {
+		// File already exists
+		return values, nil
+	}
+	// add fname to checklist, in case the transaction aborts
+	rs.MarkForGC(fName)
+	if f, ok := r.(*os.File); ok && keys.current == nil {
+		if err = os.Rename(f.Name(), fullPath); err == nil {
+			return values, os.Chmod(fullPath, 0644)
+		}
+	}
+	// Write to a temporary file first so that a partially written file is never used
+	tmpFile, err := ioutil.TempFile(filepath.Dir(fullPath), ".tmp-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmpFile.Name())
+	if err = writeFilestoreFile(tmpFile, r, keys); err != nil {
+		tmpFile.Close()
+		return nil, err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Chmod(tmpFile.Name(), 0644); err != nil {
+		return nil, err
+	}
+	return values, os.Rename(tmpFile.Name(), fullPath)
+}
+
+// Open method of the fileStorage
+//
+// Encrypted files are transparently decrypted.
+func (fileStorage) Open(rs m.AttachmentSet) (io.ReadCloser, error) {
+	r, err := openFilestoreFile(rs.FullPath(rs.StoreFname()))
+	if os.IsNotExist(err) {
+		return nil, ErrAttachmentNotFound
+	}
+	return r, err
+}
+
+// Size method of the fileStorage
+func (fileStorage) Size(rs m.AttachmentSet) (int64, error) {
+	size, err := filestoreFileSize(rs.FullPath(rs.StoreFname()))
+	if os.IsNotExist(err) {
+		return 0, ErrAttachmentNotFound
+	}
+	return size, err
+}
+
+// Delete method of the fileStorage
+func (fileStorage) Delete(rs m.AttachmentSet, storeFname string) error {
+	return os.Remove(rs.FullPath(storeFname))
+}
+
+// S3Storage stores the content of attachments in an S3 compatible object store such as
+// AWS S3 or MinIO. Objects are addressed with path-style URLs and requests are signed
+// with AWS Signature Version 4.
+//
+// The default "s3" backend is configured with the following keys of the Hexya configuration:
+// Attachment.S3.Endpoint (e.g. http://localhost:9000), Attachment.S3.Bucket,
+// Attachment.S3.Region (default us-east-1), Attachment.S3.AccessKey, Attachment.S3.SecretKey
+// and Attachment.S3.Prefix for an optional prefix of object keys.
+type S3Storage struct {
+	// Name is the name under which this backend is registered
+	Name string
+	// Config returns the configuration of the backend. It is called for each request
+	// so that configuration changes are taken into account.
+	Config func() S3Config
+	// Client is the HTTP client used for requests. http.DefaultClient is used if nil.
+	Client *http.Client
+}
+
+// S3Config is the configuration of an S3Storage
+type S3Config struct {
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	Prefix    string
+}
+
+var _ AttachmentStorage = new(S3Storage)
+
+// s3ConfigFromViper returns the S3 configuration of the Hexya configuration
+func s3ConfigFromViper() S3Config {
+	region := viper.GetString("Attachment.S3.Region")
+	if region == "" {
+		region = "us-east-1"
+	}
+	return S3Config{
+		Endpoint:  viper.GetString("Attachment.S3.Endpoint"),
+		Bucket:    viper.GetString("Attachment.S3.Bucket"),
+		Region:    region,
+		AccessKey: viper.GetString("Attachment.S3.AccessKey"),
+		SecretKey: viper.GetString("Attachment.S3.SecretKey"),
+		Prefix:    viper.GetString("Attachment.S3.Prefix"),
+	}
+}
+
+// Write method of the S3Storage
+func (s *S3Storage) Write(rs m.AttachmentSet, r io.Reader, size int64, checksum string) (m.AttachmentData, error) {
+	key := fmt.Sprintf("%s/%s", checksum[:2], checksum)
+	values := h.Attachment().NewData().SetStoreFname(fmt.Sprintf("%s:%s", s.Name, key)).SetDBDatas("")
+	resp, err := s.do(http.MethodHead, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusOK {
+		// Object already exists
+		return values, nil
+	}
+	// add fname to checklist, in case the transaction aborts
+	rs.MarkForGC(values.StoreFname())
+	resp, err = s.do(http.MethodPut, key, r, size)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, s.responseError(resp)
+	}
+	return values, nil
+}
+
+// Open method of the S3Storage
+//
+// The returned reader is seekable. The object is downloaded lazily from the
+// current position, so that seeking does not download the skipped bytes.
+func (s *S3Storage) Open(rs m.AttachmentSet) (io.ReadCloser, error) {
+	key := storageKey(rs.StoreFname())
+	size, err := s.Size(rs)
+	if err != nil {
+		return nil, err
+	}
+	return &s3ObjectReader{storage: s, key: key, size: size}, nil
+}
+
+// Size method of the S3Storage
+func (s *S3Storage) Size(rs m.AttachmentSet) (int64, error) {
+	resp, err := s.do(http.MethodHead, storageKey(rs.StoreFname()), nil, 0)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, s.responseError(resp)
+	}
+	return resp.ContentLength, nil
+}
+
+// Delete method of the S3Storage
+func (s *S3Storage) Delete(_ m.AttachmentSet, storeFname string) error {
+	resp, err := s.do(http.MethodDelete, storageKey(storeFname), nil, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
+		return s.responseError(resp)
+	}
+	return nil
+}
+
+// s3ObjectReader is a seekable reader of an S3 object.
+//
+// The object content is read with a GET request from the current offset, using a
+// Range header if the offset is not zero. The request is sent again after a seek.
+type s3ObjectReader struct {
+	storage *S3Storage
+	key     string
+	size    int64
+	offset  int64
+	body    io.ReadCloser
+}
+
+var _ io.ReadSeeker = new(s3ObjectReader)
+
+// Read method of the s3ObjectReader
+func (r *s3ObjectReader) Read(p []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		body, err := r.storage.get(r.key, r.offset)
+		if err != nil {
+			return 0, err
+		}
+		r.body = body
+	}
+	n, err := r.body.Read(p)
+	r.offset += int64(n)
+	if err == io.EOF && r.offset < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// Seek method of the s3ObjectReader
+func (r *s3ObjectReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.offset
+	case io.SeekEnd:
+		offset += r.size
+	default:
+		return 0, errors.New("s3ObjectReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("s3ObjectReader.Seek: negative position")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close method of the s3ObjectReader
+func (r *s3ObjectReader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
+
+// get returns the body of a GET request of the object with the given key from the given offset.
+func (s *S3Storage) get(key string, offset int64) (io.ReadCloser, error) {
+	req, err := s.newRequest(http.MethodGet, key, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := s.client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		return resp.Body, nil
+	case resp.StatusCode == http.StatusOK:
+		// The Range header is not supported by the server
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, offset); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+		return resp.Body, nil
+	}
+	defer resp.Body.Close()
+	return nil, s.responseError(resp)
+}
+
+// responseError returns an error for the given unexpected response
+func (s *S3Storage) responseError(resp *http.Response) error {
+	if resp.StatusCode == http.StatusNotFound {
+		return ErrAttachmentNotFound
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	return fmt.Errorf("s3 storage %s: %s %s: %s", s.Name, resp.Request.Method, resp.Status, body)
+}
+
+// do executes a signed request with the given method on the object with the given key.
+// If body is not nil, it is streamed as the size bytes long content of the object.
+func (s *S3Storage) do(method, key string, body io.Reader, size int64) (*http.Response, error) {
+	req, err := s.newRequest(method, key, body, size)
+	if err != nil {
+		return nil, err
+	}
+	return s.client().Do(req)
+}
+
+// client returns the HTTP client to use for requests
+func (s *S3Storage) client() *http.Client {
+	if s.Client == nil {
+		return http.DefaultClient
+	}
+	return s.Client
+}
+
+// newRequest returns a signed request with the given method on the object with the given key.
+// If body is not nil, it is streamed as the size bytes long content of the object.
+//
+// Headers that are not part of the signature, such as Range, can be added to the request.
+func (s *S3Storage) newRequest(method, key string, body io.Reader, size int64) (*http.Request, error) {
+	cfg := s.Config()
+	if cfg.Endpoint == "" || cfg.Bucket == "" {
+		return nil, fmt.Errorf("s3 storage %s is not configured", s.Name)
+	}
+	objectKey := key
+	if cfg.Prefix != "" {
+		objectKey = strings.Trim(cfg.Prefix, "/") + "/" + key
+	}
+	endpoint, err := url.Parse(strings.TrimRight(cfg.Endpoint, "/") + "/" + cfg.Bucket + "/" + objectKey)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, endpoint.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	payloadHash := s3EmptyPayloadHash
+	if body != nil {
+		// The payload is not hashed to be able to stream it
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+		payloadHash = "UNSIGNED-PAYLOAD"
+	}
+	signS3Request(req, payloadHash, cfg, time.Now().UTC())
+	return req, nil
+}
+
+// s3URIEncode encodes the given path as per the AWS Signature Version 4 specification
+func s3URIEncode(path string) string {
+	var res strings.Builder
+	for _, b := range []byte(path) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9',
+			b == '-', b == '_', b == '.', b == '~', b == '/':
+			res.WriteByte(b)
+		default:
+			res.WriteString(fmt.Sprintf("%%%02X", b))
+		}
+	}
+	return res.String()
+}
+
+// hmacSHA256 returns the HMAC-SHA256 of data with the given key
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EmptyPayloadHash is the SHA256 of an empty payload
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// signS3Request adds the AWS Signature Version 4 headers to the given request
+// whose payload has the given hex encoded SHA256.
+func signS3Request(req *http.Request, payloadHash string, cfg S3Config, now time.Time) {
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+	headers := map[string]string{
+		"host":                 req.URL.Host,
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           amzDate,
+	}
+	var headerNames []string
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	var canonicalHeaders strings.Builder
+	for _, name := range headerNames {
+		canonicalHeaders.WriteString(fmt.Sprintf("%s:%s\n", name, headers[name]))
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path),
+		req.URL.Query().Encode(),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", day, cfg.Region)
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+	signingKey := hmacSHA256([]byte("AWS4"+cfg.SecretKey), day)
+	signingKey = hmacSHA256(signingKey, cfg.Region)
+	signingKey = hmacSHA256(signingKey, "s3")
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		cfg.AccessKey, scope, signedHeaders, signature))
+}
+
+// s3Transport is the HTTP transport of the default "s3" backend.
+//
+// Only connecting and waiting for response headers are bounded in time, so that
+// large contents can be streamed on slow links.
+var s3Transport = &http.Transport{
+	Proxy: http.ProxyFromEnvironment,
+	DialContext: (&net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}).DialContext,
+	TLSHandshakeTimeout:   10 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	IdleConnTimeout:       90 * time.Second,
+	MaxIdleConns:          100,
+}
+
+func init() {
+	RegisterAttachmentStorage("db", dbStorage{})
+	RegisterAttachmentStorage("file", fileStorage{})
+	RegisterAttachmentStorage("s3", &S3Storage{
+		Name:   "s3",
+		Config: s3ConfigFromViper,
+		Client: &http.Client{Transport: s3Transport},
+	})
+}
@@ -4,16 +4,34 @@
 package base
 
 import (
+	"archive/zip"
+	"bytes"
+	"compress/zlib"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/security"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
+	"github.com/hexya-erp/hexya/src/tools/strutils"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
+	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 	"github.com/spf13/viper"
 )
@@ -88,3 +106,926 @@ func TestAttachment(t *testing.T) {
 		}), ShouldBeNil)
 	})
 }
+
+// newFakeS3Server returns a test server that mimics an S3 object store
+func newFakeS3Server() *httptest.Server {
+	var mu sync.Mutex
+	objects := make(map[string][]byte)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=test/") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		data, exists := objects[r.URL.Path]
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = ioutil.ReadAll(r.Body)
+		case http.MethodGet, http.MethodHead:
+			if !exists {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+}
+
+func TestAttachmentStorageBackends(t *testing.T) {
+	server := newFakeS3Server()
+	defer server.Close()
+	RegisterAttachmentStorage("s3test", &S3Storage{
+		Name: "s3test",
+		Config: func() S3Config {
+			return S3Config{Endpoint: server.URL, Bucket: "hexya", Region: "us-east-1", AccessKey: "test", SecretKey: "secret"}
+		},
+	})
+	Convey("Testing attachment storage backends", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			blob := "storage blob"
+			blobB64 := base64.StdEncoding.EncodeToString([]byte(blob))
+			blobHash := fmt.Sprintf("%x", sha1.Sum([]byte(blob)))
+			Convey("Storing in an S3 compatible store", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "s3test")
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a1").
+					SetDatas(blobB64))
+				So(a1.StoreFname(), ShouldEqual, fmt.Sprintf("s3test:%s/%s", blobHash[:2], blobHash))
+				So(a1.CurrentStorage(), ShouldEqual, "s3test")
+				So(a1.DBDatas(), ShouldBeBlank)
+				a1.Collection().InvalidateCache()
+				So(a1.Datas(), ShouldEqual, blobB64)
+				a1.Collection().InvalidateCache()
+				So(a1.WithContext("bin_size", true).Datas(), ShouldEqual, "12.00 bytes")
+				Convey("S3 contents should be read from any position", func() {
+					content, err := a1.OpenContent()
+					So(err, ShouldBeNil)
+					defer content.Close()
+					seeker, ok := content.(io.ReadSeeker)
+					So(ok, ShouldBeTrue)
+					buf := make([]byte, 4)
+					_, err = io.ReadFull(seeker, buf)
+					So(err, ShouldBeNil)
+					So(string(buf), ShouldEqual, "stor")
+					pos, err := seeker.Seek(-4, io.SeekEnd)
+					So(err, ShouldBeNil)
+					So(pos, ShouldEqual, 8)
+					_, err = io.ReadFull(seeker, buf)
+					So(err, ShouldBeNil)
+					So(string(buf), ShouldEqual, "blob")
+					_, err = seeker.Read(buf)
+					So(err, ShouldEqual, io.EOF)
+				})
+			})
+			Convey("Orphaned S3 objects should be garbage collected", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "s3test")
+				storage, _ := GetAttachmentStorage("s3test")
+				objectStatus := func(key string) int {
+					resp, err := storage.(*S3Storage).do(http.MethodHead, key, nil, 0)
+					So(err, ShouldBeNil)
+					resp.Body.Close()
+					return resp.StatusCode
+				}
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a1").
+					SetDatas(blobB64))
+				// Simulate an upload whose transaction aborted
+				orphan := "orphan blob"
+				orphanHash := fmt.Sprintf("%x", sha1.Sum([]byte(orphan)))
+				vals, err := storage.Write(a1, strings.NewReader(orphan), int64(len(orphan)), orphanHash)
+				So(err, ShouldBeNil)
+				So(vals.StoreFname(), ShouldEqual, fmt.Sprintf("s3test:%s/%s", orphanHash[:2], orphanHash))
+				So(objectStatus(storageKey(vals.StoreFname())), ShouldEqual, http.StatusOK)
+				a1.FileGC()
+				So(objectStatus(storageKey(vals.StoreFname())), ShouldEqual, http.StatusNotFound)
+				So(objectStatus(storageKey(a1.StoreFname())), ShouldEqual, http.StatusOK)
+			})
+			Convey("Forcing storage should migrate between any backends", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a1").
+					SetDatas(blobB64))
+				So(a1.CurrentStorage(), ShouldEqual, "db")
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "s3test")
+				So(a1.ForceStorage(), ShouldBeTrue)
+				So(a1.CurrentStorage(), ShouldEqual, "s3test")
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+				So(a1.ForceStorage(), ShouldBeTrue)
+				So(a1.CurrentStorage(), ShouldEqual, "file")
+				So(a1.StoreFname(), ShouldEqual, fmt.Sprintf("%s/%s", blobHash[:2], blobHash))
+				So(a1.Datas(), ShouldEqual, blobB64)
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+				So(a1.ForceStorage(), ShouldBeTrue)
+				So(a1.CurrentStorage(), ShouldEqual, "db")
+				So(a1.DBDatas(), ShouldEqual, blobB64)
+				So(a1.StoreFname(), ShouldBeBlank)
+			})
+			Convey("Unknown storages should panic", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "nowhere")
+				So(func() {
+					h.Attachment().Create(env, h.Attachment().NewData().
+						SetName("a1").
+						SetDatas(blobB64))
+				}, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentStreaming(t *testing.T) {
+	Convey("Testing streaming attachment contents", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			content := strings.Repeat("streamed attachment content\n", 100000)
+			contentHash := fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+			for _, storage := range []string{"file", "db"} {
+				storage := storage
+				Convey(fmt.Sprintf("Writing and reading a stream in %s storage", storage), func() {
+					h.ConfigParameter().NewSet(env).SetParam("attachment.location", storage)
+					a1 := h.Attachment().Create(env, h.Attachment().NewData().SetName("a1"))
+					a1.WriteContent(strings.NewReader(content), "")
+					So(a1.CurrentStorage(), ShouldEqual, storage)
+					So(a1.CheckSum(), ShouldEqual, contentHash)
+					So(a1.FileSize(), ShouldEqual, len(content))
+					So(a1.MimeType(), ShouldEqual, "text/plain; charset=utf-8")
+					So(a1.IndexContent(), ShouldStartWith, "streamed attachment content")
+					r, err := a1.OpenContent()
+					So(err, ShouldBeNil)
+					data, err := ioutil.ReadAll(r)
+					r.Close()
+					So(err, ShouldBeNil)
+					So(string(data), ShouldEqual, content)
+					a1.Collection().InvalidateCache()
+					So(a1.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte(content)))
+				})
+			}
+			Convey("Datas inverse should go through the stream API", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a1").
+					SetDatas(base64.StdEncoding.EncodeToString([]byte(content))))
+				So(a1.StoreFname(), ShouldEqual, fmt.Sprintf("%s/%s.enc", contentHash[:2], contentHash))
+				So(a1.FileSize(), ShouldEqual, len(content))
+				So(a1.CheckSum(), ShouldEqual, contentHash)
+			})
+			Convey("Empty attachments should have no stored content", func() {
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().SetName("a1"))
+				a1.WriteContent(strings.NewReader(""), "text/plain")
+				So(a1.CurrentStorage(), ShouldBeBlank)
+				r, err := a1.OpenContent()
+				So(err, ShouldBeNil)
+				data, _ := ioutil.ReadAll(r)
+				So(data, ShouldBeEmpty)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentVersions(t *testing.T) {
+	Convey("Testing attachment versions", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", filepath.Join(os.TempDir(), "versions"))
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			contents := []string{"version one", "version two", "version three"}
+			a1 := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a1").
+				SetVersioned(true).
+				SetDatas(base64.StdEncoding.EncodeToString([]byte(contents[0]))))
+			for _, content := range contents[1:] {
+				a1.SetDatas(base64.StdEncoding.EncodeToString([]byte(content)))
+			}
+			Convey("Previous contents should be kept as versions", func() {
+				versions := a1.Versions()
+				So(versions.Len(), ShouldEqual, 2)
+				So(versions.Records()[0].Version(), ShouldEqual, 2)
+				So(versions.Records()[0].CheckSum(), ShouldEqual, fmt.Sprintf("%x", sha1.Sum([]byte(contents[1]))))
+				So(versions.Records()[0].FileSize(), ShouldEqual, len(contents[1]))
+				So(versions.Records()[0].Author().ID(), ShouldEqual, security.SuperUserID)
+				So(versions.Records()[1].Version(), ShouldEqual, 1)
+			})
+			Convey("Writing the same content should not create a version", func() {
+				a1.SetDatas(base64.StdEncoding.EncodeToString([]byte(contents[2])))
+				So(a1.Versions().Len(), ShouldEqual, 2)
+			})
+			Convey("Non versioned attachments should not keep versions", func() {
+				a2 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a2").
+					SetDatas(base64.StdEncoding.EncodeToString([]byte(contents[0]))))
+				a2.SetDatas(base64.StdEncoding.EncodeToString([]byte(contents[1])))
+				So(a2.Versions().IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Restoring a version should restore its content and keep the current one", func() {
+				a1.RestoreVersion(1)
+				So(a1.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte(contents[0])))
+				So(a1.FileSize(), ShouldEqual, len(contents[0]))
+				So(a1.Versions().Len(), ShouldEqual, 3)
+				So(a1.Versions().Records()[0].CheckSum(), ShouldEqual, fmt.Sprintf("%x", sha1.Sum([]byte(contents[2]))))
+				So(func() { a1.RestoreVersion(42) }, ShouldPanic)
+			})
+			Convey("Versions should only be accessible through their attachment", func() {
+				demoUser := h.User().NewSet(env).GetRecord("base_user_demo")
+				So(a1.Sudo(demoUser.ID()).Versions().Len(), ShouldEqual, 2)
+				So(func() { h.AttachmentVersion().NewSet(env).Sudo(demoUser.ID()).SearchAll().Len() }, ShouldPanic)
+				So(func() { a1.Sudo(demoUser.ID()).Versions().SetDate(dates.Now()) }, ShouldPanic)
+				So(func() { a1.Sudo(demoUser.ID()).Versions().Unlink() }, ShouldPanic)
+				a1.Sudo().WithContext("attachment_set_datas", true).SetResField("Image")
+				So(func() { a1.Versions().Sudo(demoUser.ID()).Load() }, ShouldPanic)
+			})
+			Convey("Version files should be protected from FileGC", func() {
+				a1.FileGC()
+				for _, version := range a1.Versions().Records() {
+					_, err := os.Stat(a1.FullPath(version.StoreFname()))
+					So(err, ShouldBeNil)
+				}
+			})
+			Convey("Versions should be pruned according to the retention policy", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.version_keep", "1")
+				So(a1.PruneVersions(), ShouldEqual, 1)
+				So(a1.Versions().Len(), ShouldEqual, 1)
+				So(a1.Versions().Version(), ShouldEqual, 2)
+				oldVersion := a1.Versions().StoreFname()
+				a1.SetDatas(base64.StdEncoding.EncodeToString([]byte("version four")))
+				So(a1.Versions().Len(), ShouldEqual, 1)
+				So(a1.Versions().Version(), ShouldEqual, 3)
+				a1.FileGC()
+				_, err := os.Stat(a1.FullPath(oldVersion))
+				So(os.IsNotExist(err), ShouldBeTrue)
+				h.ConfigParameter().NewSet(env).SetParam("attachment.version_keep", "0")
+				h.ConfigParameter().NewSet(env).SetParam("attachment.version_days", "1")
+				a1.Versions().Sudo().SetDate(dates.Now().AddDate(0, 0, -2))
+				So(h.Attachment().NewSet(env).PruneVersions(), ShouldBeGreaterThanOrEqualTo, 1)
+				So(a1.Versions().IsEmpty(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+// newTestZip returns a zip archive with the given files, in the given order
+func newTestZip(files ...string) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := 0; i+1 < len(files); i += 2 {
+		f, _ := w.Create(files[i])
+		f.Write([]byte(files[i+1]))
+	}
+	w.Close()
+	return buf.Bytes()
+}
+
+func TestAttachmentContentExtraction(t *testing.T) {
+	odt := newTestZip(
+		"mimetype", "application/vnd.oasis.opendocument.text",
+		"content.xml", `<office:document-content xmlns:office="o" xmlns:text="t"><office:body>`+
+			`<text:h>Quarterly report</text:h><text:p>Revenue<text:s/>increased</text:p></office:body></office:document-content>`)
+	docx := newTestZip(
+		"[Content_Types].xml", "<Types/>",
+		"word/document.xml", `<w:document xmlns:w="w"><w:body><w:p><w:r><w:t>Signed</w:t></w:r><w:r><w:tab/>`+
+			`<w:t>contract</w:t></w:r></w:p><w:p><w:r><w:t>Second line</w:t></w:r></w:p></w:body></w:document>`)
+	xlsx := newTestZip(
+		"xl/workbook.xml", "<workbook/>",
+		"xl/sharedStrings.xml", `<sst><si><t>Alpha</t></si><si><r><t>Be</t></r><r><t>ta</t></r></si></sst>`,
+		"xl/worksheets/sheet1.xml", `<worksheet><sheetData><row><c><v>12</v></c><c t="inlineStr"><is><t>Gamma</t></is></c></row></sheetData></worksheet>`)
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	zw.Write([]byte("BT /F1 12 Tf 72 650 Td [(Compressed)-300(stream)] TJ ET"))
+	zw.Close()
+	pdf := []byte("%PDF-1.4\n1 0 obj\n<< /Length 60 >>\nstream\nBT /F1 24 Tf 100 700 Td (Invoice \\(draft\\)) Tj T* <48657821> Tj ET\nendstream\nendobj\n" +
+		fmt.Sprintf("2 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", compressed.Len()) + compressed.String() + "\nendstream\nendobj\n%%EOF")
+	Convey("Testing content extractors", t, func() {
+		Convey("Zip based documents should be recognized", func() {
+			So(zipMimeType(bytes.NewReader(odt), int64(len(odt))), ShouldEqual, mimeTypeODT)
+			So(zipMimeType(bytes.NewReader(docx), int64(len(docx))), ShouldEqual, mimeTypeDOCX)
+			So(zipMimeType(bytes.NewReader(xlsx), int64(len(xlsx))), ShouldEqual, mimeTypeXLSX)
+			other := newTestZip("readme.txt", "hello")
+			So(zipMimeType(bytes.NewReader(other), int64(len(other))), ShouldEqual, "application/zip")
+		})
+		Convey("Text should be extracted from office documents", func() {
+			text, err := ExtractOpenDocumentText(bytes.NewReader(odt), int64(len(odt)))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "Quarterly report\nRevenue increased\n")
+			text, err = ExtractDOCXText(bytes.NewReader(docx), int64(len(docx)))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "Signed contract\nSecond line\n")
+			text, err = ExtractXLSXText(bytes.NewReader(xlsx), int64(len(xlsx)))
+			So(err, ShouldBeNil)
+			So(text, ShouldEqual, "Alpha\nBeta\nGamma\n")
+		})
+		Convey("Text should be extracted from PDF documents", func() {
+			text, err := ExtractPDFText(bytes.NewReader(pdf), int64(len(pdf)))
+			So(err, ShouldBeNil)
+			So(text, ShouldContainSubstring, "Invoice (draft)\nHex!")
+			So(text, ShouldContainSubstring, "Compressed stream")
+		})
+		Convey("Decompression bombs should not be fully extracted", func() {
+			var bomb bytes.Buffer
+			zw := zlib.NewWriter(&bomb)
+			zw.Write([]byte("BT (Bomb) Tj "))
+			zw.Write(make([]byte, 4*attachmentIndexMaxSize))
+			zw.Close()
+			bombPDF := []byte("%PDF-1.4\n1 0 obj\n<< /Filter /FlateDecode >>\nstream\n" + bomb.String() +
+				"\nendstream\nendobj\n2 0 obj\n<< /Length 17 >>\nstream\nBT (After) Tj ET\nendstream\nendobj\n%%EOF")
+			text, err := ExtractPDFText(bytes.NewReader(bombPDF), int64(len(bombPDF)))
+			So(err, ShouldBeNil)
+			So(text, ShouldContainSubstring, "Bomb")
+			So(text, ShouldContainSubstring, "After")
+			bombDOCX := newTestZip("word/document.xml", "<w:document><w:t>"+strings.Repeat("a", 4*attachmentIndexMaxSize))
+			text, _ = ExtractDOCXText(bytes.NewReader(bombDOCX), int64(len(bombDOCX)))
+			So(len(text), ShouldBeLessThanOrEqualTo, attachmentIndexMaxSize)
+		})
+	})
+	Convey("Testing attachment content indexing", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			Convey("Office documents and PDF should be indexed at creation", func() {
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("report.odt").
+					SetDatas(base64.StdEncoding.EncodeToString(odt)))
+				So(a1.IndexContent(), ShouldEqual, "Quarterly report\nRevenue increased")
+				a2 := h.Attachment().Create(env, h.Attachment().NewData().SetName("invoice.pdf"))
+				a2.WriteContent(bytes.NewReader(pdf), "application/pdf")
+				So(a2.IndexContent(), ShouldContainSubstring, "Invoice (draft)")
+				Convey("Search helpers should find attachments by content", func() {
+					So(h.Attachment().NewSet(env).SearchContent("quarterly INCREASED").Ids(), ShouldContain, a1.ID())
+					So(h.Attachment().NewSet(env).SearchContent("quarterly draft").Ids(), ShouldNotContain, a1.ID())
+					So(h.Attachment().NewSet(env).SearchContent("invoice").Ids(), ShouldContain, a2.ID())
+					So(a1.ContentSnippet("revenue", 5), ShouldEqual, "Revenue incr…")
+					So(a1.ContentSnippet("nothing", 5), ShouldBeBlank)
+				})
+			})
+			Convey("Large documents should be indexed by a queue job", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.index_async_size", "10")
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("contract.docx").
+					SetDatas(base64.StdEncoding.EncodeToString(docx)))
+				So(a1.IndexContent(), ShouldBeBlank)
+				jobs := h.QueueJob().Search(env, q.QueueJob().Model().Equals("Attachment").
+					And().Method().Equals("ExtractIndexContent").
+					And().RecordsIds().Equals(fmt.Sprintf("[%d]", a1.ID())))
+				So(jobs.Len(), ShouldEqual, 1)
+				a1.ExtractIndexContent()
+				So(a1.IndexContent(), ShouldEqual, "Signed contract\nSecond line")
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentThumbnails(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 800, 600))
+	draw.Draw(img, img.Bounds(), image.NewUniform(color.RGBA{R: 200, A: 255}), image.Point{}, draw.Src)
+	var buf bytes.Buffer
+	png.Encode(&buf, img)
+	pngData := buf.Bytes()
+	thumbnailSize := func(b64 string) (int, int) {
+		data, _ := base64.StdEncoding.DecodeString(b64)
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		So(err, ShouldBeNil)
+		return config.Width, config.Height
+	}
+	Convey("Testing attachment thumbnails", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			Convey("Thumbnails should be generated for images", func() {
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("image.png").
+					SetDatas(base64.StdEncoding.EncodeToString(pngData)))
+				So(a1.MimeType(), ShouldEqual, "image/png")
+				w, ht := thumbnailSize(a1.Thumbnail512())
+				So(w, ShouldEqual, 512)
+				So(ht, ShouldEqual, 512)
+				So(a1.Thumbnail(128), ShouldEqual, a1.Thumbnail128())
+				w, ht = thumbnailSize(a1.Thumbnail(64))
+				So(w, ShouldEqual, 64)
+				So(ht, ShouldEqual, 64)
+				w, _ = thumbnailSize(a1.Thumbnail(1024))
+				So(w, ShouldEqual, 512)
+				Convey("Thumbnails should be removed with the image", func() {
+					a1.SetDatas(base64.StdEncoding.EncodeToString([]byte("not an image anymore")))
+					So(a1.Thumbnail512(), ShouldBeBlank)
+					So(a1.Thumbnail(128), ShouldBeBlank)
+				})
+			})
+			Convey("Other documents should not have thumbnails", func() {
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("text.txt").
+					SetDatas(base64.StdEncoding.EncodeToString([]byte("some text"))))
+				So(a1.Thumbnail(128), ShouldBeBlank)
+			})
+			Convey("Thumbnails of large images should be generated by a queue job", func() {
+				h.ConfigParameter().NewSet(env).SetParam("attachment.thumbnail_async_size", "10")
+				a1 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("image.png").
+					SetDatas(base64.StdEncoding.EncodeToString(pngData)))
+				So(a1.Thumbnail512(), ShouldBeBlank)
+				jobs := h.QueueJob().Search(env, q.QueueJob().Model().Equals("Attachment").
+					And().Method().Equals("GenerateThumbnails").
+					And().RecordsIds().Equals(fmt.Sprintf("[%d]", a1.ID())))
+				So(jobs.Len(), ShouldEqual, 1)
+				a1.GenerateThumbnails()
+				So(a1.Thumbnail256(), ShouldNotBeBlank)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentEncryption(t *testing.T) {
+	key1 := base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	key2 := base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+	Convey("Testing filestore encryption", t, func() {
+		defer func() {
+			viper.Set("Attachment.Encryption.MasterKey", "")
+			viper.Set("Attachment.Encryption.OldMasterKeys", []string{})
+		}()
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			// Start each test with a new filestore so that the file is written with the current key
+			os.RemoveAll(filepath.Join(os.TempDir(), "encryption"))
+			viper.Set("DataDir", filepath.Join(os.TempDir(), "encryption"))
+			viper.Set("Attachment.Encryption.MasterKey", key1)
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			content := strings.Repeat("personal data ", 10000)
+			contentB64 := base64.StdEncoding.EncodeToString([]byte(content))
+			a1 := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a1").
+				SetDatas(contentB64))
+			rawContent := func() []byte {
+				raw, err := ioutil.ReadFile(a1.FullPath(a1.StoreFname()))
+				So(err, ShouldBeNil)
+				return raw
+			}
+			Convey("Files should be encrypted and read transparently", func() {
+				contentHash := fmt.Sprintf("%x", sha1.Sum([]byte(content)))
+				So(a1.StoreFname(), ShouldEqual, fmt.Sprintf("%s/%s", contentHash[:2], contentHash))
+				raw := rawContent()
+				So(string(raw[:4]), ShouldEqual, "HXE1")
+				So(string(raw), ShouldNotContainSubstring, "personal data")
+				a1.Collection().InvalidateCache()
+				So(a1.Datas(), ShouldEqual, contentB64)
+				a1.Collection().InvalidateCache()
+				So(a1.WithContext("bin_size", true).Datas(), ShouldEqual, strutils.HumanSize(int64(len(content))))
+				So(a1.FileRead(a1.StoreFname(), false), ShouldEqual, contentB64)
+			})
+			Convey("Files encrypted with an unknown key should not be readable", func() {
+				viper.Set("Attachment.Encryption.MasterKey", key2)
+				_, err := a1.OpenContent()
+				So(err, ShouldEqual, ErrEncryptionKeyNotFound)
+			})
+			Convey("Rotating keys should re-encrypt files with the new key", func() {
+				viper.Set("Attachment.Encryption.MasterKey", key2)
+				viper.Set("Attachment.Encryption.OldMasterKeys", []string{key1})
+				before := rawContent()
+				a1.RotateEncryptionKeys()
+				So(bytes.Equal(rawContent(), before), ShouldBeFalse)
+				viper.Set("Attachment.Encryption.OldMasterKeys", []string{})
+				a1.Collection().InvalidateCache()
+				So(a1.Datas(), ShouldEqual, contentB64)
+				Convey("Rotating again should not change anything", func() {
+					before := rawContent()
+					a1.RotateEncryptionKeys()
+					So(bytes.Equal(rawContent(), before), ShouldBeTrue)
+				})
+			})
+			Convey("Disabling encryption and rotating keys should decrypt files", func() {
+				viper.Set("Attachment.Encryption.MasterKey", "")
+				viper.Set("Attachment.Encryption.OldMasterKeys", []string{key1})
+				encryptedFName := a1.StoreFname()
+				a1.RotateEncryptionKeys()
+				a1.Collection().InvalidateCache()
+				So(a1.StoreFname(), ShouldEqual, strings.TrimSuffix(encryptedFName, ".enc"))
+				So(string(rawContent()), ShouldEqual, content)
+				Convey("Enabling encryption again should encrypt plain files", func() {
+					viper.Set("Attachment.Encryption.MasterKey", key1)
+					a1.RotateEncryptionKeys()
+					a1.Collection().InvalidateCache()
+					So(a1.StoreFname(), ShouldEqual, encryptedFName)
+					So(string(rawContent()), ShouldNotContainSubstring, "personal data")
+					So(a1.Datas(), ShouldEqual, contentB64)
+				})
+			})
+			Convey("Plain files that look like encrypted files should be read as is", func() {
+				viper.Set("Attachment.Encryption.MasterKey", "")
+				fakeContent := "HXE1" + strings.Repeat("x", 200)
+				a2 := h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a2").
+					SetDatas(base64.StdEncoding.EncodeToString([]byte(fakeContent))))
+				viper.Set("Attachment.Encryption.MasterKey", key1)
+				a2.Collection().InvalidateCache()
+				So(a2.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte(fakeContent)))
+				a2.RotateEncryptionKeys()
+				a2.Collection().InvalidateCache()
+				So(a2.StoreFname(), ShouldEndWith, ".enc")
+				So(a2.Datas(), ShouldEqual, base64.StdEncoding.EncodeToString([]byte(fakeContent)))
+			})
+			Convey("Spooled contents should not be written in plain", func() {
+				spool, err := newSpoolFile(a1.FullPath("tmp"))
+				So(err, ShouldBeNil)
+				defer spool.Remove()
+				_, err = io.Copy(spool, strings.NewReader(content))
+				So(err, ShouldBeNil)
+				reader, err := spool.Rewind()
+				So(err, ShouldBeNil)
+				raw, err := ioutil.ReadFile(spool.file.Name())
+				So(err, ShouldBeNil)
+				So(string(raw), ShouldNotContainSubstring, "personal data")
+				buf := make([]byte, 13)
+				_, err = reader.ReadAt(buf, 14*5000)
+				So(err, ShouldBeNil)
+				So(string(buf), ShouldEqual, "personal data")
+				data, err := ioutil.ReadAll(reader)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, content)
+			})
+			Convey("Tampered files should be detected", func() {
+				raw := rawContent()
+				raw[len(raw)-1] ^= 0xFF
+				So(ioutil.WriteFile(a1.FullPath(a1.StoreFname()), raw, 0644), ShouldBeNil)
+				sum, err := streamCheckSum(a1.OpenContent())
+				So(sum, ShouldBeBlank)
+				So(err, ShouldEqual, ErrEncryptedFileCorrupted)
+				So(os.Remove(a1.FullPath(a1.StoreFname())), ShouldBeNil)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentQuotas(t *testing.T) {
+	Convey("Testing attachment quotas", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", os.TempDir())
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			company := h.User().NewSet(env).CurrentUser().Company()
+			newAttachment := func(name string, size int) m.AttachmentSet {
+				return h.Attachment().Create(env, h.Attachment().NewData().
+					SetName(name).
+					SetCompany(company).
+					SetDatas(base64.StdEncoding.EncodeToString([]byte(strings.Repeat(name[:1], size)))))
+			}
+			Convey("Quotas must have exactly one scope", func() {
+				So(func() {
+					h.AttachmentQuota().Create(env, h.AttachmentQuota().NewData().SetMaxFileSize(100))
+				}, ShouldPanic)
+				So(func() {
+					h.AttachmentQuota().Create(env, h.AttachmentQuota().NewData().
+						SetCompany(company).
+						SetUser(h.User().NewSet(env).CurrentUser()).
+						SetMaxFileSize(100))
+				}, ShouldPanic)
+			})
+			Convey("Company maximum file size should be enforced", func() {
+				h.AttachmentQuota().Create(env, h.AttachmentQuota().NewData().SetCompany(company).SetMaxFileSize(100))
+				So(func() { newAttachment("a1", 100) }, ShouldNotPanic)
+				So(func() { newAttachment("a2", 101) }, ShouldPanic)
+				a3 := newAttachment("a3", 10)
+				So(func() { a3.WriteContent(strings.NewReader(strings.Repeat("b", 200)), "text/plain") }, ShouldPanic)
+			})
+			Convey("Company total size should be enforced", func() {
+				usage := attachmentUsage(h.Attachment().NewSet(env), "company_id", company.ID())
+				h.AttachmentQuota().Create(env, h.AttachmentQuota().NewData().SetCompany(company).SetMaxTotalSize(usage+150))
+				a1 := newAttachment("a1", 100)
+				So(func() { newAttachment("a2", 100) }, ShouldPanic)
+				So(func() { newAttachment("a3", 50) }, ShouldNotPanic)
+				Convey("Replacing a content should only count the difference", func() {
+					So(func() { a1.SetDatas(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("c", 90)))) }, ShouldNotPanic)
+					So(func() { a1.SetDatas(base64.StdEncoding.EncodeToString([]byte(strings.Repeat("d", 120)))) }, ShouldPanic)
+				})
+			})
+			Convey("User and group quotas should be enforced", func() {
+				user := h.User().NewSet(env).CurrentUser()
+				h.AttachmentQuota().Create(env, h.AttachmentQuota().NewData().SetUser(user).SetMaxFileSize(50))
+				So(func() { newAttachment("a1", 60) }, ShouldPanic)
+				So(func() { newAttachment("a2", 40) }, ShouldNotPanic)
+				So(user.Groups().IsNotEmpty(), ShouldBeTrue)
+				h.AttachmentQuota().Create(env, h.AttachmentQuota().NewData().SetGroup(user.Groups().Records()[0]).SetMaxFileSize(20))
+				So(func() { newAttachment("a3", 30) }, ShouldPanic)
+			})
+			Convey("Usage report should aggregate sizes by company, model and user", func() {
+				partner := h.Partner().NewSet(env).GetRecord("base_res_partner_2")
+				h.Attachment().Create(env, h.Attachment().NewData().
+					SetName("a1").
+					SetCompany(company).
+					SetResModel("Partner").
+					SetResID(partner.ID()).
+					SetDatas(base64.StdEncoding.EncodeToString([]byte("usage report"))))
+				var found bool
+				for _, line := range h.Attachment().NewSet(env).UsageReport().Records() {
+					if line.ResModel() == "Partner" && line.Company().Equals(company) && line.User().ID() == env.Uid() {
+						So(line.Count(), ShouldBeGreaterThanOrEqualTo, 1)
+						So(line.TotalSize(), ShouldBeGreaterThanOrEqualTo, len("usage report"))
+						found = true
+					}
+				}
+				So(found, ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentAccessTokens(t *testing.T) {
+	Convey("Testing signed access tokens", t, func() {
+		key := []byte("secret")
+		now := time.Now()
+		token := newSignedToken(key, 12, now.Add(time.Hour), "")
+		boundToken := newSignedToken(key, 12, now.Add(time.Hour), "10.0.0.1")
+		Convey("Valid tokens should return the attachment id", func() {
+			id, err := verifySignedToken(key, token, "192.168.1.1", now)
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, 12)
+			id, err = verifySignedToken(key, boundToken, "10.0.0.1", now)
+			So(err, ShouldBeNil)
+			So(id, ShouldEqual, 12)
+		})
+		Convey("Tokens bound to another IP should be rejected", func() {
+			_, err := verifySignedToken(key, boundToken, "192.168.1.1", now)
+			So(err, ShouldEqual, ErrInvalidAccessToken)
+			_, err = verifySignedToken(key, boundToken, "", now)
+			So(err, ShouldEqual, ErrInvalidAccessToken)
+		})
+		Convey("Expired tokens should be rejected", func() {
+			_, err := verifySignedToken(key, token, "", now.Add(2*time.Hour))
+			So(err, ShouldEqual, ErrAccessTokenExpired)
+		})
+		Convey("Tampered tokens should be rejected", func() {
+			_, err := verifySignedToken(key, strings.Replace(token, "12.", "13.", 1), "", now)
+			So(err, ShouldEqual, ErrInvalidAccessToken)
+			_, err = verifySignedToken([]byte("other"), token, "", now)
+			So(err, ShouldEqual, ErrInvalidAccessToken)
+			_, err = verifySignedToken(key, "12.abc.def", "", now)
+			So(err, ShouldEqual, ErrInvalidAccessToken)
+		})
+	})
+	Convey("Testing attachment access tokens", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			attachment := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a1").
+				SetDatas(base64.StdEncoding.EncodeToString([]byte("shared content"))))
+			other := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a2").
+				SetDatas(base64.StdEncoding.EncodeToString([]byte("other content"))))
+			Convey("Signed tokens should give access to their attachment only", func() {
+				token := attachment.GenerateSignedToken(time.Hour, "")
+				So(h.ConfigParameter().NewSet(env).GetParam("database.secret", ""), ShouldNotBeEmpty)
+				So(attachment.CheckAccessToken(token, ""), ShouldBeTrue)
+				So(other.CheckAccessToken(token, ""), ShouldBeFalse)
+				So(h.Attachment().NewSet(env).GetByAccessToken(token, "").Equals(attachment), ShouldBeTrue)
+				So(h.Attachment().NewSet(env).GetByAccessToken(token+"x", "").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("IP bound tokens should only be valid for this IP", func() {
+				token := attachment.GenerateSignedToken(0, "10.0.0.1")
+				So(attachment.CheckAccessToken(token, "10.0.0.1"), ShouldBeTrue)
+				So(attachment.CheckAccessToken(token, "10.0.0.2"), ShouldBeFalse)
+				So(h.Attachment().NewSet(env).GetByAccessToken(token, "10.0.0.2").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Permanent tokens should still be accepted", func() {
+				token := attachment.GenerateAccessToken()[0]
+				So(attachment.CheckAccessToken(token, ""), ShouldBeTrue)
+				So(other.CheckAccessToken(token, ""), ShouldBeFalse)
+				So(h.Attachment().NewSet(env).GetByAccessToken(token, "").Equals(attachment), ShouldBeTrue)
+			})
+			Convey("Revoking tokens should invalidate permanent and signed tokens", func() {
+				token := attachment.GenerateAccessToken()[0]
+				otherToken := other.GenerateAccessToken()[0]
+				signedToken := attachment.GenerateSignedToken(time.Hour, "")
+				attachment.RevokeAccessTokens()
+				So(attachment.AccessToken(), ShouldBeEmpty)
+				So(attachment.CheckAccessToken(token, ""), ShouldBeFalse)
+				So(attachment.CheckAccessToken(signedToken, ""), ShouldBeFalse)
+				So(other.CheckAccessToken(otherToken, ""), ShouldBeTrue)
+				So(attachment.CheckAccessToken(attachment.GenerateSignedToken(time.Hour, ""), ""), ShouldBeTrue)
+				h.Attachment().NewSet(env).RevokeAccessTokens()
+				So(other.AccessToken(), ShouldBeEmpty)
+				So(h.Attachment().NewSet(env).GetByAccessToken(otherToken, "").IsEmpty(), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentServing(t *testing.T) {
+	Convey("Testing attachment content serving", t, func() {
+		lastUpdate := time.Date(2020, 3, 4, 10, 0, 0, 0, time.UTC)
+		info := attachmentContentInfo{
+			name:       "rapport d'été.txt",
+			mimeType:   "text/plain",
+			checkSum:   "abcdef",
+			lastUpdate: lastUpdate,
+		}
+		serve := func(header http.Header) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/attachment/1", nil)
+			for k, v := range header {
+				req.Header[k] = v
+			}
+			rec := httptest.NewRecorder()
+			serveAttachmentContent(rec, req, strings.NewReader("0123456789"), info)
+			return rec
+		}
+		Convey("Full content should be served with its headers", func() {
+			rec := serve(nil)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+			So(rec.Header().Get("Content-Type"), ShouldEqual, "text/plain")
+			So(rec.Header().Get("ETag"), ShouldEqual, `"abcdef"`)
+			So(rec.Header().Get("Last-Modified"), ShouldEqual, lastUpdate.Format(http.TimeFormat))
+			So(rec.Header().Get("Accept-Ranges"), ShouldEqual, "bytes")
+			So(rec.Header().Get("Cache-Control"), ShouldEqual, "private, no-cache")
+			So(rec.Header().Get("Content-Disposition"), ShouldEqual,
+				`inline; filename="rapport d'_t_.txt"; filename*=UTF-8''rapport%20d%27%C3%A9t%C3%A9.txt`)
+		})
+		Convey("Range requests should return partial content", func() {
+			rec := serve(http.Header{"Range": {"bytes=2-5"}})
+			So(rec.Code, ShouldEqual, http.StatusPartialContent)
+			So(rec.Body.String(), ShouldEqual, "2345")
+			So(rec.Header().Get("Content-Range"), ShouldEqual, "bytes 2-5/10")
+			rec = serve(http.Header{"Range": {"bytes=2-5"}, "If-Range": {`"other"`}})
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+		})
+		Convey("Conditional requests should return not modified", func() {
+			So(serve(http.Header{"If-None-Match": {`"abcdef"`}}).Code, ShouldEqual, http.StatusNotModified)
+			So(serve(http.Header{"If-Modified-Since": {lastUpdate.Format(http.TimeFormat)}}).Code, ShouldEqual, http.StatusNotModified)
+			req := httptest.NewRequest(http.MethodGet, "/attachment/1", nil)
+			req.Header.Set("If-None-Match", `"xyz", W/"abcdef"`)
+			So(attachmentNotModified(req, info.etag()), ShouldBeTrue)
+			req.Header.Set("If-None-Match", `"xyz"`)
+			So(attachmentNotModified(req, info.etag()), ShouldBeFalse)
+		})
+		Convey("Contents that are not seekable should be streamed in full", func() {
+			req := httptest.NewRequest(http.MethodGet, "/attachment/1", nil)
+			req.Header.Set("Range", "bytes=2-5")
+			rec := httptest.NewRecorder()
+			streamAttachmentContent(rec, req, ioutil.NopCloser(strings.NewReader("0123456789")), 10, info)
+			So(rec.Code, ShouldEqual, http.StatusOK)
+			So(rec.Body.String(), ShouldEqual, "0123456789")
+			So(rec.Header().Get("Accept-Ranges"), ShouldEqual, "none")
+			So(rec.Header().Get("Content-Length"), ShouldEqual, "10")
+			So(rec.Header().Get("ETag"), ShouldEqual, `"abcdef"`)
+		})
+		Convey("Downloads should be served as attachments", func() {
+			info.download = true
+			info.name = "report.pdf"
+			So(serve(nil).Header().Get("Content-Disposition"), ShouldEqual,
+				`attachment; filename="report.pdf"; filename*=UTF-8''report.pdf`)
+		})
+	})
+	Convey("Testing served attachments lookup", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			partner := h.Partner().NewSet(env).GetRecord("base_res_partner_2")
+			attachment := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a1").
+				SetResModel("Partner").
+				SetResID(partner.ID()).
+				SetResField("Image").
+				SetDatas(base64.StdEncoding.EncodeToString([]byte("field content"))))
+			served := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a2").
+				SetType("binary").
+				SetURL("/base/static/test.txt").
+				SetDatas(base64.StdEncoding.EncodeToString([]byte("served content"))))
+			demoUser := h.User().NewSet(env).GetRecord("base_user_demo")
+			Convey("Attachments should be found by id", func() {
+				So(h.Attachment().NewSet(env).FindServedAttachment(attachment.ID(), "", "", "").Equals(attachment), ShouldBeTrue)
+				So(h.Attachment().NewSet(env).FindServedAttachment(attachment.ID()+1000000, "", "", "").IsEmpty(), ShouldBeTrue)
+				So(func() {
+					h.Attachment().NewSet(env).Sudo(demoUser.ID()).FindServedAttachment(attachment.ID(), "", "", "")
+				}, ShouldPanic)
+			})
+			Convey("Requests without session should be executed as the public user", func() {
+				uid, err := publicUserID()
+				So(err, ShouldBeNil)
+				publicUser := h.User().NewSet(env).GetRecord("base_public_user")
+				So(uid, ShouldEqual, publicUser.ID())
+				So(publicUser.Active(), ShouldBeFalse)
+				So(publicUser.IsPublic(), ShouldBeTrue)
+				So(func() {
+					h.Attachment().NewSet(env).Sudo(uid).FindServedAttachment(served.ID(), "", "", "")
+				}, ShouldPanic)
+			})
+			Convey("Attachments should be found by URL", func() {
+				So(h.Attachment().NewSet(env).FindServedAttachment(0, "/base/static/test.txt", "", "").Equals(served), ShouldBeTrue)
+				So(h.Attachment().NewSet(env).FindServedAttachment(0, "/base/static/none.txt", "", "").IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Attachments should be found by access token", func() {
+				token := attachment.GenerateSignedToken(time.Hour, "")
+				found := h.Attachment().NewSet(env).Sudo(demoUser.ID()).FindServedAttachment(0, "", token, "")
+				So(found.Equals(attachment), ShouldBeTrue)
+				found = h.Attachment().NewSet(env).Sudo(demoUser.ID()).FindServedAttachment(attachment.ID(), "", token, "")
+				So(found.Equals(attachment), ShouldBeTrue)
+				found = h.Attachment().NewSet(env).Sudo(demoUser.ID()).FindServedAttachment(served.ID(), "", token, "")
+				So(found.IsEmpty(), ShouldBeTrue)
+			})
+			Convey("Signed URLs should point to the serving controller", func() {
+				h.ConfigParameter().NewSet(env).SetParam("web.base.url", "http://localhost:8080/")
+				signedURL := attachment.SignedURL(time.Hour, "")
+				So(signedURL, ShouldStartWith, fmt.Sprintf("http://localhost:8080/attachment/%d?access_token=%d.", attachment.ID(), attachment.ID()))
+			})
+			Convey("Database contents should be seekable", func() {
+				content, err := served.OpenContent()
+				So(err, ShouldBeNil)
+				defer content.Close()
+				seeker, ok := content.(io.ReadSeeker)
+				So(ok, ShouldBeTrue)
+				_, err = seeker.Seek(7, io.SeekStart)
+				So(err, ShouldBeNil)
+				data, err := ioutil.ReadAll(seeker)
+				So(err, ShouldBeNil)
+				So(string(data), ShouldEqual, "content")
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentMinIO(t *testing.T) {
+	if os.Getenv("HEXYA_TEST_S3_ENDPOINT") == "" {
+		t.Skip("HEXYA_TEST_S3_ENDPOINT is not set")
+	}
+	RegisterAttachmentStorage("minio", &S3Storage{
+		Name: "minio",
+		Config: func() S3Config {
+			return S3Config{
+				Endpoint:  os.Getenv("HEXYA_TEST_S3_ENDPOINT"),
+				Bucket:    os.Getenv("HEXYA_TEST_S3_BUCKET"),
+				Region:    "us-east-1",
+				AccessKey: os.Getenv("HEXYA_TEST_S3_ACCESS_KEY"),
+				SecretKey: os.Getenv("HEXYA_TEST_S3_SECRET_KEY"),
+			}
+		},
+	})
+	Convey("Testing attachments stored in MinIO", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "minio")
+			blobB64 := base64.StdEncoding.EncodeToString([]byte("minio blob"))
+			a1 := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a1").
+				SetDatas(blobB64))
+			So(a1.CurrentStorage(), ShouldEqual, "minio")
+			a1.Collection().InvalidateCache()
+			So(a1.Datas(), ShouldEqual, blobB64)
+		}), ShouldBeNil)
+	})
+}
+
+func TestAttachmentFsck(t *testing.T) {
+	Convey("Testing attachments consistency checks", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			viper.Set("DataDir", filepath.Join(os.TempDir(), "fsck"))
+			os.RemoveAll(filepath.Join(os.TempDir(), "fsck"))
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "file")
+			blobB64 := base64.StdEncoding.EncodeToString([]byte("fsck blob"))
+			a1 := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a1").
+				SetDatas(blobB64))
+			h.ConfigParameter().NewSet(env).SetParam("attachment.location", "db")
+			a2 := h.Attachment().Create(env, h.Attachment().NewData().
+				SetName("a2").
+				SetDatas(blobB64))
+			orphan := filepath.Join(a1.FileStore(), "ab", "abcdef")
+			os.MkdirAll(filepath.Dir(orphan), 0755)
+			ioutil.WriteFile(orphan, []byte("orphan"), 0644)
+			old := time.Now().Add(-2 * time.Hour)
+			os.Chtimes(orphan, old, old)
+			// issue returns the lines of the given issue about the given attachment or file
+			issue := func(lines m.AttachmentCheckLineSet, issue string, attach m.AttachmentSet, fName string) m.AttachmentCheckLineSet {
+				return lines.Filtered(func(r m.AttachmentCheckLineSet) bool {
+					if r.Issue() != issue {
+						return false
+					}
+					if fName != "" {
+						return r.StoreFname() == fName
+					}
+					return r.Attachment().Equals(attach)
+				})
+			}
+			Convey("Duplicates and orphans should be reported", func() {
+				lines := a1.Fsck(false)
+				So(issue(lines, "duplicate", a2, "").Len(), ShouldEqual, 1)
+				So(issue(lines, "orphan", nil, "ab/abcdef").Len(), ShouldEqual, 1)
+				So(issue(lines, "orphan", nil, "ab/abcdef").Repaired(), ShouldBeFalse)
+				So(issue(lines, "missing", a1, "").IsEmpty(), ShouldBeTrue)
+				_, err := os.Stat(orphan)
+				So(err, ShouldBeNil)
+			})
+			Convey("Missing files should be restored from another copy", func() {
+				os.Remove(a1.FullPath(a1.StoreFname()))
+				lines := a1.Fsck(true)
+				So(issue(lines, "missing", a1, "").Repaired(), ShouldBeTrue)
+				So(issue(lines, "orphan", nil, "ab/abcdef").Repaired(), ShouldBeTrue)
+				_, err := os.Stat(a1.FullPath(a1.StoreFname()))
+				So(err, ShouldBeNil)
+				_, err = os.Stat(orphan)
+				So(os.IsNotExist(err), ShouldBeTrue)
+			})
+			Convey("Corrupted files should be reported and repaired", func() {
+				ioutil.WriteFile(a1.FullPath(a1.StoreFname()), []byte("corrupted"), 0644)
+				lines := a1.Fsck(true)
+				So(issue(lines, "checksum", a1, "").Repaired(), ShouldBeTrue)
+				content, _ := ioutil.ReadFile(a1.FullPath(a1.StoreFname()))
+				So(string(content), ShouldEqual, "fsck blob")
+			})
+		}), ShouldBeNil)
+	})
+}
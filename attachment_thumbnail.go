@@ -0,0 +1,74 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"image"
+	// Load GIF driver, PNG and JPEG drivers are loaded by b64image
+	_ "image/gif"
+	"io"
+	"sync"
+)
+
+// A ThumbnailRenderer returns a base64 encoded PNG or JPEG image representing the
+// document read from r. The image is then resized to the thumbnail sizes.
+type ThumbnailRenderer func(r io.Reader) (string, error)
+
+var thumbnailRenderers = struct {
+	sync.RWMutex
+	renderers map[string]ThumbnailRenderer
+}{
+	renderers: make(map[string]ThumbnailRenderer),
+}
+
+// RegisterThumbnailRenderer registers the given renderer for attachments of the given MIME type.
+// Registering a renderer for an existing MIME type replaces it.
+//
+// Renderers are registered for PNG, JPEG and GIF images. There is no PDF renderer by default
+// since rendering PDF pages requires a PDF engine that is not available in pure Go.
+func RegisterThumbnailRenderer(mimeType string, renderer ThumbnailRenderer) {
+	thumbnailRenderers.Lock()
+	defer thumbnailRenderers.Unlock()
+	thumbnailRenderers.renderers[baseMimeType(mimeType)] = renderer
+}
+
+// GetThumbnailRenderer returns the renderer registered for the given MIME type
+func GetThumbnailRenderer(mimeType string) (ThumbnailRenderer, bool) {
+	thumbnailRenderers.RLock()
+	defer thumbnailRenderers.RUnlock()
+	renderer, ok := thumbnailRenderers.renderers[baseMimeType(mimeType)]
+	return renderer, ok
+}
+
+// thumbnailMaxPixels is the maximum number of pixels of the images that are rendered as thumbnails.
+// Larger images are ignored since they would need too much memory to be decoded.
+const thumbnailMaxPixels = 50000000
+
+// errImageTooLarge is returned when an image has more than thumbnailMaxPixels pixels
+var errImageTooLarge = errors.New("image is too large to render a thumbnail")
+
+// renderImageThumbnail is the ThumbnailRenderer of images, which are their own preview.
+func renderImageThumbnail(r io.Reader) (string, error) {
+	var data bytes.Buffer
+	config, _, err := image.DecodeConfig(io.TeeReader(r, &data))
+	if err != nil {
+		return "", err
+	}
+	if config.Width*config.Height > thumbnailMaxPixels {
+		return "", errImageTooLarge
+	}
+	if _, err = io.Copy(&data, r); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(data.Bytes()), nil
+}
+
+func init() {
+	RegisterThumbnailRenderer("image/png", renderImageThumbnail)
+	RegisterThumbnailRenderer("image/jpeg", renderImageThumbnail)
+	RegisterThumbnailRenderer("image/gif", renderImageThumbnail)
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 NDP Systèmes. All Rights Reserved.
+// See LICENSE file for full licensing details.
+
+package base
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Signed access tokens have the form "<attachment id>.<expiry unix time>.<signature>",
+// where the signature is the HMAC-SHA256 of the attachment id, the expiry time and the
+// client IP address the token is bound to, if any. They can therefore be verified
+// without reading the attachment from the database.
+
+var (
+	// ErrInvalidAccessToken is returned when a signed access token is malformed or has a wrong signature
+	ErrInvalidAccessToken = errors.New("invalid access token")
+	// ErrAccessTokenExpired is returned when a signed access token has expired
+	ErrAccessTokenExpired = errors.New("access token has expired")
+)
+
+// signAttachmentToken returns the signature of a token for the given attachment id, expiry time and IP.
+func signAttachmentToken(key []byte, id, expiry int64, ip string) []byte {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%d.%d.%s", id, expiry, ip)
+	return mac.Sum(nil)
+}
+
+// newSignedToken returns a signed access token for the given attachment id which is valid
+// until expiry. If ip is not empty, the token is only valid for requests from this address.
+func newSignedToken(key []byte, id int64, expiry time.Time, ip string) string {
+	signature := signAttachmentToken(key, id, expiry.Unix(), ip)
+	return fmt.Sprintf("%d.%d.%s", id, expiry.Unix(), base64.RawURLEncoding.EncodeToString(signature))
+}
+
+// isSignedToken returns true if the given token looks like a signed access token
+// and not like a permanent access token.
+func isSignedToken(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// verifySignedToken checks the given signed access token for a request from ip at the given time.
+// It returns the id of the attachment this token grants access to.
+func verifySignedToken(key []byte, token, ip string, now time.Time) (int64, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return 0, ErrInvalidAccessToken
+	}
+	id, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAccessToken
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, ErrInvalidAccessToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, ErrInvalidAccessToken
+	}
+	// The token is valid if it is not bound to an IP address or bound to the client's one
+	if !hmac.Equal(signature, signAttachmentToken(key, id, expiry, "")) &&
+		(ip == "" || !hmac.Equal(signature, signAttachmentToken(key, id, expiry, ip))) {
+		return 0, ErrInvalidAccessToken
+	}
+	if now.Unix() > expiry {
+		return 0, ErrAccessTokenExpired
+	}
+	return id, nil
+}
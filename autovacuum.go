@@ -31,6 +31,7 @@ func autoVacuum_PowerOn(rs m.AutoVacuumSet) {
 	if rs.Env().Uid() != security.SuperUserID {
 		panic("Access Denied")
 	}
+	h.Attachment().NewSet(rs.Env()).PruneVersions()
 	h.Attachment().NewSet(rs.Env()).FileGC()
 	rs.GCUserLogs()
 }
@@ -8,10 +8,14 @@ import (
 	"fmt"
 	"io/ioutil"
 	"path/filepath"
+	"strconv"
+	"time"
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
 	"github.com/hexya-erp/hexya/src/models/operator"
+	"github.com/hexya-erp/hexya/src/models/types"
+	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/hexya/src/server"
 	"github.com/hexya-erp/hexya/src/tools/b64image"
 	"github.com/hexya-erp/pool/h"
@@ -75,6 +79,14 @@ var fields_Company = map[string]models.FieldDefinition{
 	"Website":         fields.Char{Related: "Partner.Website"},
 	"VAT":             fields.Char{Related: "Partner.VAT"},
 	"CompanyRegistry": fields.Char{Size: 64},
+	"Code":            fields.Char{Size: 16, Help: "Short code of the company, e.g. to be used in document numbers"},
+	"FiscalYearLastDay": fields.Integer{String: "Fiscal Year Last Day", Required: true,
+		Default: models.DefaultValue(31), GoType: new(int)},
+	"FiscalYearLastMonth": fields.Selection{String: "Fiscal Year Last Month", Required: true,
+		Selection: types.Selection{
+			"1": "January", "2": "February", "3": "March", "4": "April", "5": "May", "6": "June",
+			"7": "July", "8": "August", "9": "September", "10": "October", "11": "November", "12": "December",
+		}, Default: models.DefaultValue("12")},
 	"Favicon": fields.Binary{String: "Company Favicon", Default: func(env models.Environment) interface{} {
 		fileName := filepath.Join(server.ResourceDir, "static", "web", "src", "img", "favicon.ico")
 		imgData, _ := ioutil.ReadFile(fileName)
@@ -117,6 +129,31 @@ func company_OnChangeCountry(rs m.CompanySet) m.CompanyData {
 	return h.Company().NewData().SetCurrency(rs.Country().Currency())
 }
 
+// FiscalYearBounds returns the first and last days of the fiscal year of this company that contains date
+func company_FiscalYearBounds(rs m.CompanySet, date dates.Date) (dates.Date, dates.Date) {
+	lastMonth, _ := strconv.Atoi(rs.FiscalYearLastMonth())
+	if lastMonth < 1 || lastMonth > 12 {
+		lastMonth = 12
+	}
+	lastDay := rs.FiscalYearLastDay()
+	fiscalYearEnd := func(year int) dates.Date {
+		// Day 0 of next month is the last day of lastMonth
+		monthEnd := time.Date(year, time.Month(lastMonth)+1, 0, 0, 0, 0, 0, date.Location())
+		day := lastDay
+		if day <= 0 || day > monthEnd.Day() {
+			day = monthEnd.Day()
+		}
+		return dates.Date{Time: time.Date(year, time.Month(lastMonth), day, 0, 0, 0, 0, date.Location())}
+	}
+	day := date.SetDay(date.Day())
+	dateTo := fiscalYearEnd(day.Year())
+	if dateTo.Lower(day) {
+		dateTo = fiscalYearEnd(day.Year() + 1)
+	}
+	dateFrom := fiscalYearEnd(dateTo.Year()-1).AddDate(0, 0, 1)
+	return dateFrom, dateTo
+}
+
 // CompanyDefaultGet returns the default company (usually the user's company).`,
 func company_CompanyDefaultGet(rs m.CompanySet) m.CompanySet {
 	return h.User().NewSet(rs.Env()).GetCompany()
@@ -137,9 +174,19 @@ func company_Create(rs m.CompanySet, data m.CompanyData) m.CompanySet {
 	data.SetPartner(partner)
 	company := rs.Super().Create(data)
 	partner.SetCompany(company)
+	company.ProvisionSequences()
 	return company
 }
 
+// ProvisionSequences creates the per company copies of template sequences for this company
+func company_ProvisionSequences(rs m.CompanySet) {
+	for _, company := range rs.Records() {
+		h.Sequence().NewSet(rs.Env()).Sudo().
+			Search(q.Sequence().CompanyTemplate().Equals(true)).
+			ProvisionCompany(company)
+	}
+}
+
 // CheckParent checks that there is no recursion in the company tree`,
 func company_CheckParent(rs m.CompanySet) {
 	rs.CheckRecursion()
@@ -170,6 +217,8 @@ func init() {
 	h.Company().NewMethod("GetEuro", company_GetEuro)
 	h.Company().NewMethod("OnChangeCountry", company_OnChangeCountry)
 	h.Company().NewMethod("CompanyDefaultGet", company_CompanyDefaultGet)
+	h.Company().NewMethod("FiscalYearBounds", company_FiscalYearBounds)
+	h.Company().NewMethod("ProvisionSequences", company_ProvisionSequences)
 	h.Company().Methods().Create().Extend(company_Create)
 	h.Company().NewMethod("CheckParent", company_CheckParent)
 	h.Company().Methods().SearchByName().Extend(company_SearchByName)
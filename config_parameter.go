@@ -6,6 +6,7 @@ package base
 import (
 	"fmt"
 
+	"github.com/google/uuid"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
 	"github.com/hexya-erp/pool/h"
@@ -22,6 +23,9 @@ var defaultParameters = map[string]func(env models.Environment) (string, m.Group
 		}
 		return fmt.Sprintf("%s://localhost:%s", prefix, viper.GetString("Server.Port")), h.Group().NewSet(env)
 	},
+	"database.secret": func(env models.Environment) (string, m.GroupSet) {
+		return uuid.New().String(), h.Group().NewSet(env).Sudo().Search(q.Group().GroupID().Equals(GroupSystem.ID()))
+	},
 }
 
 var fields_ConfigParameter = map[string]models.FieldDefinition{
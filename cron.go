@@ -4,10 +4,17 @@
 package base
 
 import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
+	"sort"
+	"sync"
 	"time"
 
+	"github.com/hexya-erp/hexya/src/actions"
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
 	"github.com/hexya-erp/hexya/src/models/security"
@@ -22,7 +29,7 @@ var fields_Cron = map[string]models.FieldDefinition{
 	"Name": fields.Char{Required: true},
 	"User": fields.Many2One{RelationModel: h.User(), Required: true, Default: func(env models.Environment) interface{} {
 		return h.User().NewSet(env).CurrentUser()
-	}},
+	}, Constraint: h.Cron().Methods().CheckParameters()},
 	"Active":         fields.Boolean{Default: models.DefaultValue(true)},
 	"IntervalNumber": fields.Integer{Default: models.DefaultValue(1), Help: "Repeat every x.", GoType: new(int)},
 	"IntervalType": fields.Selection{Selection: types.Selection{
@@ -41,26 +48,68 @@ var fields_Cron = map[string]models.FieldDefinition{
 	"Arguments": fields.Text{Default: models.DefaultValue("[]"), Constraint: h.Cron().Methods().CheckParameters(),
 		Help: `Use a JSON list format (e.g. [[1, 2], "My string value", true]).
 For relation fields, pass the ID or the list of IDs`},
+	"Channel": fields.Many2One{RelationModel: h.QueueChannel(),
+		Default: func(env models.Environment) interface{} {
+			return h.QueueChannel().NewSet(env).GetRecord("base_default_channel")
+		}, Help: "Queue channel on which the jobs of this scheduled action are executed."},
+	"Priority": fields.Integer{Help: "Priority of the jobs of this scheduled action. Lower values are executed first."},
+	"JitterWindow": fields.Integer{String: "Jitter Window (s)", GoType: new(int),
+		Help: `If set, each execution is delayed by a random number of seconds up to this value,
+so that crons scheduled at the same time do not all hit the queue at once.`},
+	"NoOverlap": fields.Boolean{String: "Prevent Overlap",
+		Help: "If set, a new execution is not queued while a previous job of this scheduled action is still active."},
+	"OverlapPolicy": fields.Selection{Selection: types.Selection{
+		"skip":  "Skip the occurrence",
+		"defer": "Defer until the previous job ends",
+	}, Default: models.DefaultValue("skip"),
+		Help: `What to do when an execution is due while a previous job is still active:
+- Skip: the occurrence is dropped and the next call is scheduled as usual
+- Defer: the occurrence is kept and queued as soon as the previous job ends`},
+	"SkipCount":    fields.Integer{String: "Skipped Executions", ReadOnly: true, GoType: new(int)},
+	"LastSkipDate": fields.DateTime{String: "Last Skipped Execution", ReadOnly: true},
+	"Jobs":         fields.One2Many{RelationModel: h.QueueJob(), ReverseFK: "Cron", String: "Executions"},
+	"LastRunDate": fields.DateTime{String: "Last Execution Date", Compute: h.Cron().Methods().ComputeHistory(),
+		Help: "Date at which the last job of this scheduled action started."},
+	"LastState": fields.Selection{Selection: QueueJobStates, String: "Last Execution State",
+		Compute: h.Cron().Methods().ComputeHistory()},
+	"LastError": fields.Text{String: "Last Execution Error", Compute: h.Cron().Methods().ComputeHistory()},
+	"RunCount": fields.Integer{String: "Number of Executions", Compute: h.Cron().Methods().ComputeHistory(),
+		GoType: new(int)},
+	"AverageDuration": fields.Float{String: "Average Duration (s)", Compute: h.Cron().Methods().ComputeHistory(),
+		Help: "Average duration in seconds of the finished executions of this scheduled action."},
 }
 
-// CheckParameters checks if model, method, record ids and arguments are correct
-func cron_CheckParameters(rs m.QueueJobSet) {
-	// Check model exists
-	relModel := models.Registry.MustGet(rs.Model())
-	// Check we can parse ids
+// CheckParameters checks that the model, method, record ids and arguments of this cron are
+// correct and that the cron's user is allowed to execute the method.
+func cron_CheckParameters(rs m.CronSet) {
+	relModel, ok := models.Registry.Get(rs.Model())
+	if !ok {
+		panic(rs.T("Model %s does not exist", rs.Model()))
+	}
+	meth, ok := relModel.Methods().Get(rs.Method())
+	if !ok {
+		panic(rs.T("Method %s does not exist on model %s", rs.Method(), rs.Model()))
+	}
 	var ids []int64
 	if err := json.Unmarshal([]byte(rs.RecordsIds()), &ids); err != nil {
-		panic(fmt.Errorf("unable to unmarshal RecordIds: %s", err))
+		panic(rs.T("unable to unmarshal RecordIds: %s", err))
 	}
-	// Check we can parse arguments
 	var arguments []interface{}
 	if err := json.Unmarshal([]byte(rs.Arguments()), &arguments); err != nil {
-		panic(fmt.Errorf("unable to unmarshal Arguments: %s", err))
+		panic(rs.T("unable to unmarshal Arguments: %s", err))
 	}
-	// Check we have the right number of arguments
-	meth := relModel.Methods().MustGet(rs.Method())
 	if len(arguments) != meth.MethodType().NumIn()-1 {
-		panic(fmt.Errorf("wrong number of arguments given: expect %d arguments, received %v", meth.MethodType().NumIn()-1, arguments))
+		panic(rs.T("wrong number of arguments given: expect %d arguments, received %v", meth.MethodType().NumIn()-1, arguments))
+	}
+	records := relModel.Browse(rs.Env(), ids)
+	if _, err := convertJobArguments(records, meth, arguments); err != nil {
+		panic(rs.T("wrong argument type for method %s: %s", rs.Method(), err))
+	}
+	if rs.User().IsEmpty() {
+		return
+	}
+	if !records.Sudo(rs.User().ID()).CheckExecutionPermission(meth, true) {
+		panic(rs.T("User %s is not allowed to execute method %s on model %s", rs.User().Name(), rs.Method(), rs.Model()))
 	}
 }
 
@@ -82,36 +131,237 @@ func cron_GetFutureCall(rs m.CronSet) dates.DateTime {
 	return res
 }
 
+// CreateJob queues a new job that executes this cron's method and returns it.
+func cron_CreateJob(rs m.CronSet) m.QueueJobSet {
+	rs.EnsureOne()
+	data := h.QueueJob().NewData().
+		SetName(fmt.Sprintf("Cron Job: %s", rs.Name())).
+		SetModel(rs.Model()).
+		SetMethod(rs.Method()).
+		SetRecordsIds(rs.RecordsIds()).
+		SetArguments(rs.Arguments()).
+		SetUser(rs.User()).
+		SetPriority(rs.Priority()).
+		SetCron(rs)
+	if rs.Channel().IsNotEmpty() {
+		data.SetChannel(rs.Channel())
+	}
+	return h.QueueJob().Create(rs.Env(), data)
+}
+
+// RunNow queues an immediate execution of these crons without changing their next call date.
+func cron_RunNow(rs m.CronSet) m.QueueJobSet {
+	jobs := h.QueueJob().NewSet(rs.Env())
+	for _, cron := range rs.Records() {
+		jobs = jobs.Union(cron.CreateJob())
+	}
+	return jobs
+}
+
+// JitterDelay returns the delay to apply to the current occurrence of this cron.
+// The delay is pseudo-random within JitterWindow but stable for a given NextCall,
+// so that it does not change from one scheduling pass to the other.
+func cron_JitterDelay(rs m.CronSet) time.Duration {
+	if rs.JitterWindow() <= 0 {
+		return 0
+	}
+	hash := fnv.New64a()
+	fmt.Fprintf(hash, "%d-%d", rs.ID(), rs.NextCall().Unix())
+	return time.Duration(hash.Sum64()%uint64(rs.JitterWindow())) * time.Second
+}
+
+// queueJobFinishedStates are the states of QueueJobStates in which a job will not run anymore
+var queueJobFinishedStates = map[string]bool{"done": true, "failed": true}
+
+// queueJobActiveStates returns the states of QueueJobStates of a job that is not finished yet.
+func queueJobActiveStates() []string {
+	var res []string
+	for state := range QueueJobStates {
+		if !queueJobFinishedStates[state] {
+			res = append(res, state)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
+
+// HasActiveJobs returns true if a job created by this cron is still pending or running.
+func cron_HasActiveJobs(rs m.CronSet) bool {
+	return h.QueueJob().Search(rs.Env(),
+		q.QueueJob().Cron().Equals(rs).And().State().In(queueJobActiveStates())).IsNotEmpty()
+}
+
+// ComputeHistory computes the execution statistics of this cron from the jobs it created.
+//
+// Statistics are aggregated in the database and only the last job is loaded, so that
+// the cost does not grow with the number of executions.
+func cron_ComputeHistory(rs m.CronSet) m.CronData {
+	res := h.Cron().NewData()
+	var stats struct {
+		RunCount        int             `db:"run_count"`
+		AverageDuration sql.NullFloat64 `db:"average_duration"`
+	}
+	rs.Env().Cr().Get(&stats, `
+		SELECT COUNT(*) AS run_count, AVG(EXTRACT(EPOCH FROM date_done - date_started)) AS average_duration
+		FROM queue_job
+		WHERE cron_id = ?`, rs.ID())
+	res.SetRunCount(stats.RunCount)
+	if stats.RunCount == 0 {
+		return res
+	}
+	lastJob := h.QueueJob().Search(rs.Env(), q.QueueJob().Cron().Equals(rs)).
+		OrderBy("CreateDate DESC", "ID DESC").
+		Limit(1)
+	res.SetLastRunDate(lastJob.DateStarted())
+	res.SetLastState(lastJob.State())
+	res.SetLastError(lastJob.ExcInfo())
+	if stats.AverageDuration.Valid {
+		res.SetAverageDuration(stats.AverageDuration.Float64)
+	}
+	return res
+}
+
+// ActionOpenJobs returns an action listing the jobs created by this cron.
+func cron_ActionOpenJobs(rs m.CronSet) *actions.Action {
+	rs.EnsureOne()
+	return &actions.Action{
+		Name:     rs.T("Executions"),
+		Type:     actions.ActionActWindow,
+		Model:    "QueueJob",
+		ViewMode: "tree,form",
+		Domain:   fmt.Sprintf("[('cron_id', '=', %d)]", rs.ID()),
+		Context:  types.NewContext().WithKey("default_cron_id", rs.ID()),
+	}
+}
+
 func init() {
 	models.NewModel("Cron")
 	h.Cron().AddFields(fields_Cron)
 
 	h.Cron().NewMethod("CheckParameters", cron_CheckParameters)
 	h.Cron().NewMethod("FutureCallDate", cron_GetFutureCall)
+	h.Cron().NewMethod("CreateJob", cron_CreateJob)
+	h.Cron().NewMethod("RunNow", cron_RunNow)
+	h.Cron().NewMethod("JitterDelay", cron_JitterDelay)
+	h.Cron().NewMethod("HasActiveJobs", cron_HasActiveJobs)
+	h.Cron().NewMethod("ComputeHistory", cron_ComputeHistory)
+	h.Cron().NewMethod("ActionOpenJobs", cron_ActionOpenJobs)
 
 	models.RegisterWorker(models.NewWorkerFunction(runCron, 30*time.Second))
 }
 
+// CronLeaderLockID is the key of the PostgreSQL advisory lock held by
+// the server in charge of scheduling crons.
+const CronLeaderLockID int64 = 0x6865787961637200
+
+// A cronLeader elects the server that schedules crons when several
+// servers share the same database.
+//
+// The leader is the server holding the CronLeaderLockID session advisory
+// lock on a dedicated connection. If this connection is lost or when the
+// server stops, the lock is released by PostgreSQL and another server takes over.
+type cronLeader struct {
+	sync.Mutex
+	db   *sql.DB
+	conn *sql.Conn
+}
+
+// cronElection is the cronLeader of this server
+var cronElection cronLeader
+
+// IsLeader returns true if this server is the cron leader.
+// It tries to acquire the leadership if no other server holds it.
+func (cl *cronLeader) IsLeader() bool {
+	cl.Lock()
+	defer cl.Unlock()
+	ctx := context.Background()
+	if cl.conn != nil {
+		if err := cl.conn.PingContext(ctx); err == nil {
+			return true
+		}
+		log.Warn("Lost cron leader connection")
+		releaseCronLeaderConn(cl.conn)
+		cl.conn = nil
+	}
+	if cl.db == nil {
+		params := models.DBParams()
+		db, err := sql.Open(params.Driver, params.ConnectionString())
+		if err != nil {
+			log.Warn("Unable to open cron leader connection", "error", err)
+			return false
+		}
+		cl.db = db
+	}
+	conn, err := cl.db.Conn(ctx)
+	if err != nil {
+		log.Warn("Unable to open cron leader connection", "error", err)
+		return false
+	}
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", CronLeaderLockID).Scan(&locked); err != nil {
+		releaseCronLeaderConn(conn)
+		return false
+	}
+	if !locked {
+		conn.Close()
+		return false
+	}
+	cl.conn = conn
+	log.Info("This server is now the cron leader")
+	return true
+}
+
+// releaseCronLeaderConn releases the cron leader lock held by the session of conn and
+// closes it. Closing a *sql.Conn returns its session to the pool, so the connection is
+// discarded if the lock cannot be released, for PostgreSQL to drop the lock with the session.
+func releaseCronLeaderConn(conn *sql.Conn) {
+	if _, err := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", CronLeaderLockID); err != nil {
+		conn.Raw(func(interface{}) error {
+			return driver.ErrBadConn
+		})
+	}
+	conn.Close()
+}
+
 // runCron is registered in the core Hexya loop to check and run crons.
+//
+// Only the cron leader schedules crons.
 func runCron() {
-	var cronIds []int64
+	if !cronElection.IsLeader() {
+		return
+	}
+	var cronIds, skippedIds []int64
 	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		var toReschedule, skipped []int64
 		crons := h.Cron().Search(env, q.Cron().NextCall().Lower(dates.Now()))
 		for _, cron := range crons.Records() {
-			h.QueueJob().Create(env, h.QueueJob().NewData().
-				SetName(fmt.Sprintf("Cron Job: %s", cron.Name())).
-				SetModel(cron.Model()).
-				SetMethod(cron.Method()).
-				SetRecordsIds(cron.RecordsIds()).
-				SetArguments(cron.Arguments()).
-				SetUser(cron.User()))
+			if dates.Now().Lower(cron.NextCall().Add(cron.JitterDelay())) {
+				continue
+			}
+			if cron.NoOverlap() && cron.HasActiveJobs() {
+				if cron.OverlapPolicy() == "defer" {
+					log.Debug("Deferring cron execution while previous job is active", "cron", cron.Name())
+					continue
+				}
+				log.Info("Skipping cron execution while previous job is active", "cron", cron.Name())
+				skipped = append(skipped, cron.ID())
+				toReschedule = append(toReschedule, cron.ID())
+				continue
+			}
+			cron.CreateJob()
+			toReschedule = append(toReschedule, cron.ID())
 		}
-		cronIds = crons.Ids()
+		cronIds, skippedIds = toReschedule, skipped
 	})
 	// Set next call in a different transaction in case creating the job failed and rolled back
 	models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
 		for _, cron := range h.Cron().Browse(env, cronIds).Records() {
 			cron.SetNextCall(cron.FutureCallDate())
 		}
+		for _, cron := range h.Cron().Browse(env, skippedIds).Records() {
+			cron.Write(h.Cron().NewData().
+				SetSkipCount(cron.SkipCount() + 1).
+				SetLastSkipDate(dates.Now()))
+		}
 	})
 }
@@ -85,6 +85,8 @@ For relation fields, pass the ID or the list of IDs`},
 	"Retry":        fields.Integer{String: "Current try"},
 	"MaxRetries": fields.Integer{Help: `The job will fail if the number of tries reach the max. retries.
 Retries are infinite when equals zero.`},
+	"Cron": fields.Many2One{RelationModel: h.Cron(), String: "Scheduled Action", Index: true, ReadOnly: true,
+		OnDelete: models.SetNull, Help: "The scheduled action that created this job, if any"},
 }
 
 // CheckParameters checks if model, method, record ids and arguments are correct
@@ -118,32 +120,58 @@ func queueJob_Run(rs m.QueueJobSet) string {
 	records := models.Registry.MustGet(rs.Model()).Browse(rs.Env(), ids)
 	var arguments []interface{}
 	json.Unmarshal([]byte(rs.Arguments()), &arguments)
-	methArgs := make([]interface{}, len(arguments))
 	meth := records.Collection().Model().Methods().MustGet(rs.Method())
+	methArgs, err := convertJobArguments(records, meth, arguments)
+	if err != nil {
+		panic(err)
+	}
+
+	res := records.Call(rs.Method(), methArgs...)
+	if res != nil {
+		if resString, ok := res.(string); ok {
+			return resString
+		}
+	}
+	return "Job executed successfully."
+}
+
+// convertJobArguments converts the given JSON decoded arguments to the types
+// expected by meth when called on records. It returns an error if one of the
+// arguments cannot be converted.
+//
+// Arguments that already have the expected type are passed as is and nil
+// arguments are replaced by the zero value of the expected type.
+func convertJobArguments(records *models.RecordCollection, meth *models.Method, arguments []interface{}) ([]interface{}, error) {
+	methArgs := make([]interface{}, len(arguments))
 	for i := 1; i < meth.MethodType().NumIn(); i++ {
 		arg := arguments[i-1]
 		methArgType := meth.MethodType().In(i)
 		switch {
 		case methArgType.Implements(reflect.TypeOf((*models.RecordSet)(nil)).Elem()):
-			relRc := rs.Env().Pool(records.ModelName())
-			typesutils.Convert(arg, relRc, true)
+			relRc := records.Env().Pool(records.ModelName())
+			if err := typesutils.Convert(arg, relRc, true); err != nil {
+				return nil, fmt.Errorf("argument %d: %s", i, err)
+			}
 			methArgs[i-1] = relRc
 		case methArgType.Implements(reflect.TypeOf((*models.RecordData)(nil)).Elem()):
 			relRD := models.NewModelDataFromRS(records)
-			typesutils.Convert(arg, relRD, false)
+			if err := typesutils.Convert(arg, relRD, false); err != nil {
+				return nil, fmt.Errorf("argument %d: %s", i, err)
+			}
 			methArgs[i-1] = relRD
-		default:
+		case arg == nil:
+			methArgs[i-1] = reflect.Zero(methArgType).Interface()
+		case reflect.TypeOf(arg).AssignableTo(methArgType):
 			methArgs[i-1] = arg
+		default:
+			val := reflect.New(methArgType)
+			if err := typesutils.Convert(arg, val.Interface(), false); err != nil {
+				return nil, fmt.Errorf("argument %d: %s", i, err)
+			}
+			methArgs[i-1] = val.Elem().Interface()
 		}
 	}
-
-	res := records.Call(rs.Method(), methArgs...)
-	if res != nil {
-		if resString, ok := res.(string); ok {
-			return resString
-		}
-	}
-	return "Job executed successfully."
+	return methArgs, nil
 }
 
 // OnChannel sets the Channel of this job to the channel with the given name
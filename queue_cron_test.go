@@ -13,6 +13,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -283,6 +284,12 @@ func TestWorkerQueueAndCron(t *testing.T) {
 					So(job.Method(), ShouldEqual, c.method)
 					So(job.RecordsIds(), ShouldEqual, fmt.Sprintf("[%d]", asusID))
 					So(job.Arguments(), ShouldEqual, c.args)
+					So(job.Cron().Equals(cron), ShouldBeTrue)
+					So(cron.RunCount(), ShouldEqual, 1)
+					So(cron.LastState(), ShouldBeIn, []string{"pending", "enqueued", "running", "done"})
+					action := cron.ActionOpenJobs()
+					So(action.Model, ShouldEqual, "QueueJob")
+					So(action.Domain, ShouldEqual, fmt.Sprintf("[('cron_id', '=', %d)]", cron.ID()))
 
 					So(cron.NextCall(), ShouldNotEqual, startTime)
 					switch c.intType {
@@ -310,14 +317,19 @@ func TestWorkerQueueAndCron(t *testing.T) {
 				SetRecordsIds("[1,2]").
 				SetArguments("[]")
 			cData.SetModel("NoModel")
-			So(func() { h.Cron().Create(env, cData) }, ShouldPanicWith, `Unknown model
-	model : NoModel
-`)
+			So(func() { h.Cron().Create(env, cData) }, ShouldPanicWith, "Model NoModel does not exist")
 			cData.SetModel("Partner").SetMethod("NoMethod")
-			So(func() { h.Cron().Create(env, cData) }, ShouldPanicWith, `Unknown method in model
-	model : Partner
-	method : NoMethod
-`)
+			So(func() { h.Cron().Create(env, cData) }, ShouldPanicWith, "Method NoMethod does not exist on model Partner")
+			cData.SetMethod("ParsePartnerName").SetArguments("[12]")
+			So(func() { h.Cron().Create(env, cData) }, ShouldPanicWith,
+				"wrong argument type for method ParsePartnerName: argument 1: impossible conversion of 12 (float64) to string")
+			demoUser := h.User().NewSet(env).GetRecord("base_user_demo")
+			cData.SetModel("Currency").SetMethod("Write").SetArguments(`[{"Name": "EUR"}]`).SetUser(demoUser)
+			So(func() { h.Cron().Create(env, cData) }, ShouldPanicWith,
+				fmt.Sprintf("User %s is not allowed to execute method Write on model Currency", demoUser.Name()))
+			cron := h.Cron().Create(env, cData.SetUser(h.User().NewSet(env).CurrentUser()))
+			So(func() { cron.SetUser(demoUser) }, ShouldPanicWith,
+				fmt.Sprintf("User %s is not allowed to execute method Write on model Currency", demoUser.Name()))
 		}), ShouldBeNil)
 
 		err := models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
@@ -359,6 +371,149 @@ func TestWorkerQueueAndCron(t *testing.T) {
 		errTitle = strings.Split(err.Error(), "\n-------")[0]
 		So(errTitle, ShouldEqual, `wrong number of arguments given: expect 0 arguments, received [too many args]`)
 	})
+	Convey("Testing cron routing and manual execution", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			channel := h.QueueChannel().Create(env, h.QueueChannel().NewData().SetName("Cron Channel"))
+			nextCall := dates.Now().AddWeeks(1)
+			cron := h.Cron().Create(env, h.Cron().NewData().
+				SetName("Routed cron").
+				SetModel("Partner").
+				SetMethod("NameGet").
+				SetRecordsIds(fmt.Sprintf("[%d]", asusID)).
+				SetChannel(channel).
+				SetPriority(5).
+				SetNextCall(nextCall))
+			job := cron.RunNow()
+			So(job.Len(), ShouldEqual, 1)
+			So(job.Channel().Equals(channel), ShouldBeTrue)
+			So(job.Priority(), ShouldEqual, 5)
+			So(job.Cron().Equals(cron), ShouldBeTrue)
+			So(cron.NextCall().Truncate(time.Millisecond), ShouldEqual, nextCall.Truncate(time.Millisecond))
+			defCron := h.Cron().Create(env, h.Cron().NewData().
+				SetName("Default channel cron").
+				SetModel("Partner").
+				SetMethod("NameGet").
+				SetRecordsIds(fmt.Sprintf("[%d]", asusID)).
+				SetNextCall(nextCall))
+			defJob := defCron.RunNow()
+			So(defJob.Channel().HexyaExternalID(), ShouldEqual, "base_default_channel")
+		}), ShouldBeNil)
+	})
+	Convey("Testing active job states", t, func() {
+		So(queueJobActiveStates(), ShouldResemble, []string{"enqueued", "pending", "started"})
+	})
+	Convey("Testing cron leader election", t, func() {
+		So(cronElection.IsLeader(), ShouldBeTrue)
+		var otherServer cronLeader
+		So(otherServer.IsLeader(), ShouldBeFalse)
+		So(cronElection.IsLeader(), ShouldBeTrue)
+		Convey("Released connections should not keep the leadership", func() {
+			cronElection.Lock()
+			releaseCronLeaderConn(cronElection.conn)
+			cronElection.conn = nil
+			cronElection.Unlock()
+			So(otherServer.IsLeader(), ShouldBeTrue)
+			So(cronElection.IsLeader(), ShouldBeFalse)
+			releaseCronLeaderConn(otherServer.conn)
+			otherServer.conn = nil
+			So(cronElection.IsLeader(), ShouldBeTrue)
+		})
+	})
+	Convey("Testing cron jitter", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			cron := h.Cron().Create(env, h.Cron().NewData().
+				SetName("Jitter cron").
+				SetModel("Partner").
+				SetMethod("NameGet").
+				SetRecordsIds(fmt.Sprintf("[%d]", asusID)).
+				SetNextCall(dates.Now().AddWeeks(1)))
+			So(cron.JitterDelay(), ShouldEqual, 0)
+			cron.SetJitterWindow(600)
+			delay := cron.JitterDelay()
+			So(delay, ShouldBeGreaterThanOrEqualTo, 0)
+			So(delay, ShouldBeLessThan, 600*time.Second)
+			So(cron.JitterDelay(), ShouldEqual, delay)
+		}), ShouldBeNil)
+	})
+	Convey("Testing cron overlap prevention", t, func() {
+		var skipCronID, deferCronID, channelID int64
+		nextCall := dates.Now().Add(-time.Minute)
+		Convey("Creating crons with an active job", func() {
+			So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				// Jobs on a channel without capacity are never run
+				channel := h.QueueChannel().Create(env, h.QueueChannel().NewData().
+					SetName("Overlap Channel").
+					SetCapacity(0))
+				channelID = channel.ID()
+				for _, policy := range []string{"skip", "defer"} {
+					cron := h.Cron().Create(env, h.Cron().NewData().
+						SetName("Overlap cron "+policy).
+						SetIntervalType("days").
+						SetModel("Partner").
+						SetMethod("NameGet").
+						SetRecordsIds(fmt.Sprintf("[%d]", asusID)).
+						SetNoOverlap(true).
+						SetOverlapPolicy(policy).
+						SetNextCall(nextCall))
+					h.QueueJob().Create(env, h.QueueJob().NewData().
+						SetName("Overlap job "+policy).
+						SetModel("Partner").
+						SetMethod("NameGet").
+						SetRecordsIds(fmt.Sprintf("[%d]", asusID)).
+						SetChannel(channel).
+						SetCron(cron))
+					if policy == "skip" {
+						skipCronID = cron.ID()
+						continue
+					}
+					deferCronID = cron.ID()
+				}
+			}), ShouldBeNil)
+		})
+		Convey("Skipped cron should be rescheduled and deferred cron should not", func() {
+			<-time.After(300 * time.Millisecond)
+			So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				skipCron := h.Cron().BrowseOne(env, skipCronID)
+				So(skipCron.Jobs().Len(), ShouldEqual, 1)
+				So(skipCron.SkipCount(), ShouldEqual, 1)
+				So(skipCron.LastSkipDate().IsZero(), ShouldBeFalse)
+				So(skipCron.NextCall().Greater(nextCall), ShouldBeTrue)
+				deferCron := h.Cron().BrowseOne(env, deferCronID)
+				So(deferCron.Jobs().Len(), ShouldEqual, 1)
+				So(deferCron.SkipCount(), ShouldEqual, 0)
+				So(deferCron.NextCall().Truncate(time.Millisecond), ShouldEqual, nextCall.Truncate(time.Millisecond))
+			}), ShouldBeNil)
+		})
+		Convey("Cleaning up", func() {
+			So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+				h.Cron().Browse(env, []int64{skipCronID, deferCronID}).Unlink()
+				h.QueueJob().Search(env, q.QueueJob().Name().Contains("Overlap job ")).Unlink()
+				h.QueueChannel().BrowseOne(env, channelID).Unlink()
+			}), ShouldBeNil)
+		})
+	})
+	Convey("Job arguments should be converted to the method parameter types", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			newJob := func(method, arguments string) m.QueueJobSet {
+				return h.QueueJob().Create(env, h.QueueJob().NewData().
+					SetName("Arguments job").
+					SetModel("Partner").
+					SetMethod(method).
+					SetRecordsIds(fmt.Sprintf("[%d]", asusID)).
+					SetArguments(arguments))
+			}
+			So(newJob("ParsePartnerName", `["John Doe <john@example.com>"]`).Run(), ShouldEqual, "John Doe")
+			So(newJob("ParsePartnerName", `[null]`).Run(), ShouldEqual, "")
+			meth := models.Registry.MustGet("Attachment").Methods().MustGet("Thumbnail")
+			records := h.Attachment().NewSet(env).Collection()
+			args, err := convertJobArguments(records, meth, []interface{}{float64(128)})
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []interface{}{128})
+			args, err = convertJobArguments(records, meth, []interface{}{nil})
+			So(err, ShouldBeNil)
+			So(args, ShouldResemble, []interface{}{0})
+		}), ShouldBeNil)
+	})
 	Convey("Cleaning crons and jobs", t, func() {
 		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
 			h.Partner().BrowseOne(env, asusID).SetName("ASUSTeK")
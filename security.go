@@ -42,6 +42,13 @@ func init() {
 
 	h.Attachment().Methods().Load().AllowGroup(security.GroupEveryone)
 	h.Attachment().Methods().AllowAllToGroup(GroupUser)
+	h.AttachmentVersion().Methods().Load().AllowGroup(GroupUser)
+	h.AttachmentVersion().Methods().Search().AllowGroup(GroupUser, h.Attachment().Methods().Versions())
+	h.AttachmentVersion().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentQuota().Methods().Load().AllowGroup(GroupUser)
+	h.AttachmentQuota().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentUsageLine().Methods().AllowAllToGroup(GroupSystem)
+	h.AttachmentCheckLine().Methods().AllowAllToGroup(GroupSystem)
 
 	h.User().Methods().Load().AllowGroup(security.GroupEveryone)
 	h.User().Methods().HasGroup().AllowGroup(security.GroupEveryone)
@@ -81,4 +88,5 @@ func init() {
 	h.Sequence().Methods().AllowAllToGroup(GroupSystem)
 	h.SequenceDateRange().Methods().Load().AllowGroup(GroupUser)
 	h.SequenceDateRange().Methods().AllowAllToGroup(GroupSystem)
+	h.SequenceAuditLine().Methods().AllowAllToGroup(GroupSystem)
 }
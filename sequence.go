@@ -4,12 +4,20 @@
 package base
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/hexya-erp/hexya/src/models"
 	"github.com/hexya-erp/hexya/src/models/fields"
+	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
@@ -37,6 +45,174 @@ var SequenceFuncs = map[string]func(time.Time) string{
 	},
 }
 
+// SequenceTemplateFuncs are the helper functions available in the NumberFormat template of a
+// sequence in addition to the keys of Sequences and SequenceFuncs (e.g. {{year}} or {{range_month}}).
+var SequenceTemplateFuncs = template.FuncMap{
+	"pad": func(value interface{}, size int) string {
+		return fmt.Sprintf("%0*s", size, fmt.Sprint(value))
+	},
+	"upper": strings.ToUpper,
+	"lower": strings.ToLower,
+	"formatDate": func(t time.Time, layout string) string {
+		return t.Format(layout)
+	},
+}
+
+// SequenceCheckDigits maps check digit algorithms to the function computing the check
+// characters of a reference. Letters are converted to 10..35 and other non-digit characters
+// are ignored, so that check digits can also be computed over a full alphanumeric reference.
+var SequenceCheckDigits = map[string]func(string) string{
+	"luhn":  LuhnCheckDigit,
+	"mod97": Mod97CheckDigits,
+	"mod11": Mod11CheckDigit,
+}
+
+// checkDigitInput returns the digits of the given reference over which check digits are computed
+func checkDigitInput(reference string) []int {
+	var res []int
+	for _, r := range strings.ToUpper(reference) {
+		switch {
+		case r >= '0' && r <= '9':
+			res = append(res, int(r-'0'))
+		case r >= 'A' && r <= 'Z':
+			val := int(r-'A') + 10
+			res = append(res, val/10, val%10)
+		}
+	}
+	return res
+}
+
+// LuhnCheckDigit returns the Luhn (mod 10) check digit of the given reference
+func LuhnCheckDigit(reference string) string {
+	digits := checkDigitInput(reference)
+	var sum int
+	for i := range digits {
+		d := digits[len(digits)-1-i]
+		if i%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return fmt.Sprintf("%d", (10-sum%10)%10)
+}
+
+// Mod97CheckDigits returns the two ISO 7064 MOD 97-10 check digits of the given reference
+func Mod97CheckDigits(reference string) string {
+	var rem int
+	for _, d := range checkDigitInput(reference) {
+		rem = (rem*10 + d) % 97
+	}
+	return fmt.Sprintf("%02d", 98-(rem*100)%97)
+}
+
+// Mod11CheckDigit returns the ISO 7064 MOD 11-2 check character of the given reference.
+// The check character is 'X' when the computed value is 10.
+func Mod11CheckDigit(reference string) string {
+	var p int
+	for _, d := range checkDigitInput(reference) {
+		p = ((p + d) * 2) % 11
+	}
+	check := (12 - p) % 11
+	if check == 10 {
+		return "X"
+	}
+	return fmt.Sprintf("%d", check)
+}
+
+// SequenceNumberings maps the numbering formats of sequences to the alphabet of their digits.
+// The first character of each alphabet is the zero digit, used for padding.
+var SequenceNumberings = map[string]string{
+	"decimal":   "0123456789",
+	"base36":    "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"letters":   "ABCDEFGHIJKLMNOPQRSTUVWXYZ",
+	"crockford": "0123456789ABCDEFGHJKMNPQRSTVWXYZ",
+}
+
+// EncodeNumber returns number written with the digits of the given alphabet,
+// left padded with the zero digit of the alphabet to padding characters.
+func EncodeNumber(number int64, alphabet string, padding int) string {
+	if number < 0 {
+		return "-" + EncodeNumber(-number, alphabet, padding)
+	}
+	base := int64(len(alphabet))
+	var res []byte
+	for {
+		res = append(res, alphabet[number%base])
+		number /= base
+		if number == 0 {
+			break
+		}
+	}
+	for len(res) < padding {
+		res = append(res, alphabet[0])
+	}
+	for i, j := 0, len(res)-1; i < j; i, j = i+1, j-1 {
+		res[i], res[j] = res[j], res[i]
+	}
+	return string(res)
+}
+
+// DecodeNumber returns the number written with the digits of the given alphabet.
+// Decoding is case insensitive. For the Crockford alphabet, I and L are read as 1 and O as 0.
+func DecodeNumber(value string, alphabet string) (int64, error) {
+	value = strings.ToUpper(value)
+	if alphabet == SequenceNumberings["crockford"] {
+		value = strings.NewReplacer("I", "1", "L", "1", "O", "0").Replace(value)
+	}
+	base := int64(len(alphabet))
+	var res int64
+	for _, r := range value {
+		digit := strings.IndexRune(alphabet, r)
+		if digit < 0 {
+			return 0, fmt.Errorf("invalid digit %q in %s", r, value)
+		}
+		res = res*base + int64(digit)
+	}
+	return res, nil
+}
+
+// sequencePlaceholderRegex matches interpolation keys such as %(year)s in prefixes and suffixes
+var sequencePlaceholderRegex = regexp.MustCompile(`%\([a-z0-9_]+\)s`)
+
+// SequenceTemplateData is the data passed to the NumberFormat template of a sequence
+type SequenceTemplateData struct {
+	// Number is the raw number drawn from the sequence
+	Number int64
+	// Padded is Number padded with zeros to the sequence's Padding,
+	// followed by its check digits if the sequence computes them over the number
+	Padded string
+	// Record is the record being numbered as given by Sequence.WithRecord, or nil
+	Record interface{}
+	// Company is the company of the sequence, or the current user's company
+	Company m.CompanySet
+	// Sequence is the sequence being drawn
+	Sequence m.SequenceSet
+	// Date is the effective date of the number
+	Date time.Time
+	// RangeDate is the start date of the date range of the number
+	RangeDate time.Time
+}
+
+var fields_SequenceAuditLine = map[string]models.FieldDefinition{
+	"Sequence":  fields.Many2One{RelationModel: h.Sequence(), Required: true, OnDelete: models.Cascade},
+	"DateRange": fields.Many2One{RelationModel: h.SequenceDateRange(), OnDelete: models.Cascade},
+	"Series":    fields.Char{Help: "Reference text around the number, the number being replaced by #"},
+	"Issue": fields.Selection{Selection: types.Selection{
+		"missing":      "Missing",
+		"duplicate":    "Duplicate",
+		"out_of_order": "Out of Order",
+		"invalid":      "Invalid Check Digits",
+		"unparsed":     "Unparsed",
+	}, Required: true},
+	"Number":    fields.Integer{},
+	"Reference": fields.Char{},
+	"ResModel":  fields.Char{String: "Resource Model"},
+	"ResID":     fields.Integer{String: "Resource ID"},
+}
+
 var fields_Sequence = map[string]models.FieldDefinition{
 	"Name": fields.Char{Required: true},
 	"Code": fields.Char{String: "Sequence Code"},
@@ -49,6 +225,9 @@ gap in the sequence (while they are possible in the former).`},
 	"Active": fields.Boolean{Default: models.DefaultValue(true), Required: true},
 	"Prefix": fields.Char{Help: "Prefix value of the record for the sequence"},
 	"Suffix": fields.Char{Help: "Suffix value of the record for the sequence"},
+	"NumberFormat": fields.Text{String: "Number Format",
+		Help: `Optional Go template of the whole number, e.g. INV/{{.Company.Code}}/{{year}}/{{.Padded}}.
+When set, the prefix and suffix are ignored.`},
 	"NumberNext": fields.Integer{String: "Next Number", Required: true,
 		Default: models.DefaultValue(1), Help: "Next number of this sequence"},
 	"NumberNextActual": fields.Integer{
@@ -58,23 +237,316 @@ gap in the sequence (while they are possible in the former).`},
 		Depends: []string{"NumberNext"}},
 	"NumberIncrement": fields.Integer{String: "Step", Required: true,
 		Default: models.DefaultValue(1), Help: "The next number of the sequence will be incremented by this number"},
+	"LockStrategy": fields.Selection{String: "Lock Strategy", Selection: types.Selection{
+		"wait":   "Wait with Timeout",
+		"retry":  "Retry with Backoff",
+		"nowait": "Fail Immediately",
+	}, Required: true, Default: models.DefaultValue("wait"),
+		Help: `How concurrent transactions drawing a number from a "No Gap" sequence are handled.
+Wait with Timeout: wait until the other transaction commits, at most Lock Timeout milliseconds.
+Retry with Backoff: try again up to Lock Retries times, doubling the delay between attempts.
+Fail Immediately: raise an error as soon as the sequence is locked.`},
+	"LockTimeout": fields.Integer{String: "Lock Timeout (ms)", Default: models.DefaultValue(5000),
+		Help: "Maximum time to wait for the lock of a \"No Gap\" sequence with the 'Wait with Timeout' strategy"},
+	"LockRetries": fields.Integer{String: "Lock Retries", Default: models.DefaultValue(5), GoType: new(int),
+		Help: "Number of retries to get the lock of a \"No Gap\" sequence with the 'Retry with Backoff' strategy"},
 	"Padding": fields.Integer{String: "Sequence Size", Required: true,
 		Default: models.DefaultValue(0),
 		Help:    "Hexya will automatically adds some '0' on the left of the 'Next Number' to get the required padding size."},
+	"Numbering": fields.Selection{String: "Numbering Format", Selection: types.Selection{
+		"decimal":   "Decimal",
+		"base36":    "Base 36 (0-9, A-Z)",
+		"letters":   "Letters (A, B, ... Z, BA, BB...)",
+		"crockford": "Crockford Base 32",
+	}, Required: true, Default: models.DefaultValue("decimal"),
+		Help: `How the number is written. The number is padded with the first digit of the format,
+i.e. 0 or A for Letters, so that number 0 with a size of 2 is AA, and number 1 is AB.`},
+	"CheckDigit": fields.Selection{String: "Check Digit", Selection: types.Selection{
+		"luhn":  "Luhn",
+		"mod97": "ISO 7064 MOD 97-10",
+		"mod11": "ISO 7064 MOD 11-2",
+	}, Help: "Algorithm of the check digits appended to the numbers of this sequence"},
+	"CheckDigitScope": fields.Selection{String: "Check Digit Over", Selection: types.Selection{
+		"number": "Padded Number",
+		"full":   "Full Reference",
+	}, Required: true, Default: models.DefaultValue("number"),
+		Help: `Padded Number: the check digits are computed over the padded number and placed right after it.
+Full Reference: the check digits are computed over the whole reference including prefix and suffix and appended to it.`},
 	"Company": fields.Many2One{RelationModel: h.Company(), Default: func(env models.Environment) interface{} {
 		return h.Company().NewSet(env).CompanyDefaultGet()
 	}},
+	"CompanyTemplate": fields.Boolean{String: "Per Company Template", NoCopy: true,
+		Help: "If set, a copy of this sequence is automatically created for each new company"},
 	"UseDateRange": fields.Boolean{String: "Use subsequences per Date Range"},
+	"RangePeriod": fields.Selection{String: "Date Range Period", Selection: types.Selection{
+		"year":        "Yearly",
+		"quarter":     "Quarterly",
+		"month":       "Monthly",
+		"week":        "Weekly",
+		"fiscal_year": "Fiscal Year",
+	}, Required: true, Default: models.DefaultValue("year"),
+		Help: `Period of the subsequences that are automatically created.
+Fiscal Year uses the fiscal year of the sequence's company.`},
 	"DateRanges": fields.One2Many{RelationModel: h.SequenceDateRange(), ReverseFK: "Sequence",
 		String: "Subsequences"},
 }
 
+// sequencePlaceholderPattern returns the regular expression matching the value of the
+// given interpolation key, so that adjacent keys and the number can be told apart.
+func sequencePlaceholderPattern(key string) string {
+	key = strings.TrimPrefix(strings.TrimPrefix(key, "range_"), "current_")
+	if format, ok := Sequences[key]; ok {
+		return fmt.Sprintf(`\d{%d}`, len(format))
+	}
+	// Days and weeks of year are not zero padded by SequenceFuncs
+	switch key {
+	case "doy":
+		return `\d{1,3}`
+	case "woy":
+		return `\d{1,2}`
+	case "weekday":
+		return `\d`
+	}
+	return `\d+`
+}
+
+// ParseRegex returns a regular expression matching the references generated by this
+// sequence. The number is captured by the 'number' group and interpolated keys by
+// groups named after the keys. It panics if the sequence uses a number format template.
+func sequence_ParseRegex(rs m.SequenceSet) *regexp.Regexp {
+	rs.EnsureOne()
+	if rs.NumberFormat() != "" {
+		panic(rs.T("References of sequence %s cannot be parsed because it uses a number format", rs.Name()))
+	}
+	toRegex := func(format string) string {
+		var res strings.Builder
+		last := 0
+		for _, loc := range sequencePlaceholderRegex.FindAllStringIndex(format, -1) {
+			res.WriteString(regexp.QuoteMeta(format[last:loc[0]]))
+			key := format[loc[0]+2 : loc[1]-2]
+			res.WriteString(fmt.Sprintf(`(?P<%s>%s)`, key, sequencePlaceholderPattern(key)))
+			last = loc[1]
+		}
+		res.WriteString(regexp.QuoteMeta(format[last:]))
+		return res.String()
+	}
+	var check string
+	if checkFunc, ok := SequenceCheckDigits[rs.CheckDigit()]; ok {
+		check = fmt.Sprintf(`[0-9Xx]{%d}`, len(checkFunc("0")))
+	}
+	minWidth := rs.Padding()
+	if minWidth < 1 {
+		minWidth = 1
+	}
+	numberPart := fmt.Sprintf(`(?P<number>[%s]{%d,})`, regexp.QuoteMeta(rs.NumberingAlphabet()), minWidth)
+	if rs.CheckDigitScope() == "full" {
+		return regexp.MustCompile("^" + toRegex(rs.Prefix()) + numberPart + toRegex(rs.Suffix()) + check + "$")
+	}
+	return regexp.MustCompile("^" + toRegex(rs.Prefix()) + numberPart + check + toRegex(rs.Suffix()) + "$")
+}
+
+// subexpIndex returns the index of the first subexpression of re with the given name, or -1
+func subexpIndex(re *regexp.Regexp, name string) int {
+	for i, subName := range re.SubexpNames() {
+		if name != "" && subName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Audit checks the references of this sequence actually used in the given field of the
+// given model and returns a line for each missing, duplicated, out-of-order, invalid or
+// unparseable reference.
+//
+// References are parsed back with the prefix, suffix and padding of the sequence and
+// grouped by series, i.e. by their text around the number. Each series is assigned the
+// date range of the sequence matching the dates parsed from the reference if any.
+// Records are expected to have been numbered in the order of their IDs.
+func sequence_Audit(rs m.SequenceSet, modelName, fieldName string) m.SequenceAuditLineSet {
+	rs.EnsureOne()
+	model, ok := models.Registry.Get(modelName)
+	if !ok {
+		panic(rs.T("Model %s does not exist", modelName))
+	}
+	if _, ok = model.Fields().Get(fieldName); !ok {
+		panic(rs.T("Field %s does not exist on model %s", fieldName, modelName))
+	}
+	if rs.NumberIncrement() <= 0 {
+		panic(rs.T("Sequence %s cannot be audited because its step is not positive", rs.Name()))
+	}
+	field := model.FieldName(fieldName)
+	parseRegex := rs.ParseRegex()
+	type auditRef struct {
+		reference string
+		number    int64
+		resID     int64
+	}
+	type auditSeries struct {
+		name      string
+		dateRange m.SequenceDateRangeSet
+		refs      []auditRef
+	}
+	res := h.SequenceAuditLine().NewSet(rs.Env())
+	newLine := func(issue string, series *auditSeries, ref auditRef) {
+		data := h.SequenceAuditLine().NewData().
+			SetSequence(rs).
+			SetIssue(issue).
+			SetNumber(ref.number).
+			SetReference(ref.reference).
+			SetResModel(modelName).
+			SetResID(ref.resID)
+		if series != nil {
+			data.SetSeries(series.name).SetDateRange(series.dateRange)
+		}
+		res = res.Union(h.SequenceAuditLine().Create(rs.Env(), data))
+	}
+	seriesByName := make(map[string]*auditSeries)
+	var seriesNames []string
+	records := rs.Env().Pool(modelName).Search(model.Field(field).IsNotNull()).OrderBy("ID")
+	for _, rec := range records.Records() {
+		reference := fmt.Sprint(rec.Get(field))
+		if reference == "" {
+			continue
+		}
+		ref := auditRef{reference: reference, resID: rec.Ids()[0]}
+		match := parseRegex.FindStringSubmatchIndex(reference)
+		if match == nil {
+			newLine("unparsed", nil, ref)
+			continue
+		}
+		numIndex := subexpIndex(parseRegex, "number")
+		ref.number, _ = DecodeNumber(reference[match[2*numIndex]:match[2*numIndex+1]], rs.NumberingAlphabet())
+		if !rs.ValidateNumber(reference) {
+			newLine("invalid", nil, ref)
+			continue
+		}
+		// The series name is the reference without its number and check digits
+		numEnd := match[2*numIndex+1]
+		if checkFunc, ok := SequenceCheckDigits[rs.CheckDigit()]; ok {
+			if rs.CheckDigitScope() == "full" {
+				reference = reference[:len(reference)-len(checkFunc("0"))]
+			} else {
+				numEnd += len(checkFunc("0"))
+			}
+		}
+		name := reference[:match[2*numIndex]] + "#" + reference[numEnd:]
+		series, exists := seriesByName[name]
+		if !exists {
+			series = &auditSeries{name: name, dateRange: h.SequenceDateRange().NewSet(rs.Env())}
+			if rs.UseDateRange() {
+				series.dateRange = sequenceAuditDateRange(rs, parseRegex, ref.reference, match)
+			}
+			seriesByName[name] = series
+			seriesNames = append(seriesNames, name)
+		}
+		series.refs = append(series.refs, ref)
+	}
+	sort.Strings(seriesNames)
+	for _, name := range seriesNames {
+		series := seriesByName[name]
+		seen := make(map[int64]bool)
+		var maxNumber int64
+		minNumber := series.refs[0].number
+		for _, ref := range series.refs {
+			switch {
+			case seen[ref.number]:
+				newLine("duplicate", series, ref)
+			case ref.number < maxNumber:
+				newLine("out_of_order", series, ref)
+			}
+			seen[ref.number] = true
+			if ref.number > maxNumber {
+				maxNumber = ref.number
+			}
+			if ref.number < minNumber {
+				minNumber = ref.number
+			}
+		}
+		start := minNumber
+		if !series.dateRange.IsEmpty() {
+			start = 1
+		}
+		for number := start; number < maxNumber; number += rs.NumberIncrement() {
+			if !seen[number] {
+				newLine("missing", series, auditRef{number: number})
+			}
+		}
+	}
+	return res
+}
+
+// sequenceAuditDateRange returns the date range of the given sequence that contains the
+// date parsed from the given reference match, or an empty set if no date can be parsed.
+func sequenceAuditDateRange(rs m.SequenceSet, parseRegex *regexp.Regexp, reference string, match []int) m.SequenceDateRangeSet {
+	values := make(map[string]int)
+	for i, name := range parseRegex.SubexpNames() {
+		if name == "" || name == "number" || match[2*i] < 0 {
+			continue
+		}
+		values[name], _ = strconv.Atoi(reference[match[2*i]:match[2*i+1]])
+	}
+	value := func(keys ...string) (int, bool) {
+		for _, key := range keys {
+			if val, ok := values[key]; ok {
+				return val, true
+			}
+		}
+		return 0, false
+	}
+	year, ok := value("range_year", "year")
+	if !ok {
+		year, ok = value("range_y", "y")
+		if !ok {
+			return h.SequenceDateRange().NewSet(rs.Env())
+		}
+		year += 2000
+	}
+	month, ok := value("range_month", "month")
+	if !ok {
+		month = 1
+	}
+	day, ok := value("range_day", "day")
+	if !ok {
+		day = 1
+	}
+	date := dates.Date{Time: time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.UTC)}
+	return h.SequenceDateRange().Search(rs.Env(),
+		q.SequenceDateRange().Sequence().Equals(rs).
+			And().DateFrom().LowerOrEqual(date).
+			And().DateTo().GreaterOrEqual(date)).
+		Limit(1)
+}
+
 // ComputeNumberNextActual returns the real next number for the sequence depending on the implementation
 func sequence_ComputeNumberNextActual(rs m.SequenceSet) m.SequenceData {
-	res := h.Sequence().NewData().SetNumberNextActual(rs.NumberNext())
+	next := rs.NumberNext()
+	if rs.Implementation() == "standard" && rs.ID() != 0 {
+		next = predictHexyaSequence(rs.Env(), fmt.Sprintf("sequence_%03d", rs.ID()), next)
+	}
+	res := h.Sequence().NewData().SetNumberNextActual(next)
 	return res
 }
 
+// predictHexyaSequence returns the value that the next call to nextval on the
+// given sequence will return, without consuming it. It returns fallback if the
+// sequence does not exist.
+func predictHexyaSequence(env models.Environment, name string, fallback int64) int64 {
+	hexyaSeq, ok := models.Registry.GetSequence(name)
+	if !ok {
+		return fallback
+	}
+	var state struct {
+		LastValue int64 `db:"last_value"`
+		IsCalled  bool  `db:"is_called"`
+	}
+	env.Cr().Get(&state, fmt.Sprintf("SELECT last_value, is_called FROM %s", hexyaSeq.JSON))
+	if !state.IsCalled {
+		return state.LastValue
+	}
+	return state.LastValue + hexyaSeq.Increment
+}
+
 // InverseNumberNextActual is the setter function for the NumberNextActual field
 func sequence_InverseNumberNextActual(rs m.SequenceSet, value int64) {
 	if value == 0 {
@@ -168,16 +640,270 @@ func sequence_NextDo(rs m.SequenceSet) string {
 	return rs.GetNextChar(rs.UpdateNoGap())
 }
 
+// NextNDo returns the count next sequence numbers formatted.
+// The numbers are reserved as a single contiguous block.
+func sequence_NextNDo(rs m.SequenceSet, count int) []string {
+	rs.EnsureOne()
+	if count <= 0 {
+		return []string{}
+	}
+	var first int64
+	if rs.Implementation() == "standard" {
+		hexyaSeq := models.Registry.MustGetSequence(fmt.Sprintf("sequence_%03d", rs.ID()))
+		first = reserveHexyaSequence(hexyaSeq, int64(count))
+	} else {
+		first = rs.ReserveNoGap(int64(count))
+	}
+	res := make([]string, count)
+	for i := range res {
+		res[i] = rs.GetNextChar(first + int64(i)*rs.NumberIncrement())
+	}
+	return res
+}
+
+// reserveHexyaSequence reserves count consecutive values of the given DB sequence and returns
+// the first one. The reservation is made in its own short transaction because altering the
+// sequence blocks concurrent draws until commit.
+func reserveHexyaSequence(hexyaSeq *models.Sequence, count int64) int64 {
+	if count < 1 {
+		log.Panic("At least one number must be reserved", "sequence", hexyaSeq.JSON, "count", count)
+	}
+	var first int64
+	err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+		var state struct {
+			LastValue int64 `db:"last_value"`
+			IsCalled  bool  `db:"is_called"`
+		}
+		var value int64
+		env.Cr().Execute(fmt.Sprintf("ALTER SEQUENCE %s INCREMENT BY %d", hexyaSeq.JSON, count*hexyaSeq.Increment))
+		env.Cr().Get(&state, fmt.Sprintf("SELECT last_value, is_called FROM %s", hexyaSeq.JSON))
+		env.Cr().Get(&value, fmt.Sprintf("SELECT nextval('%s')", hexyaSeq.JSON))
+		first = value - (count-1)*hexyaSeq.Increment
+		if !state.IsCalled {
+			// The first nextval of a sequence returns its start value whatever the increment
+			first = value
+			env.Cr().Get(&value, fmt.Sprintf("SELECT setval('%s', %d)", hexyaSeq.JSON, first+(count-1)*hexyaSeq.Increment))
+		}
+		env.Cr().Execute(fmt.Sprintf("ALTER SEQUENCE %s INCREMENT BY %d", hexyaSeq.JSON, hexyaSeq.Increment))
+	})
+	if err != nil {
+		panic(err)
+	}
+	return first
+}
+
 // UpdateNoGap gets the next number of a "No Gap" sequence
 func sequence_UpdateNoGap(rs m.SequenceSet) int64 {
+	return rs.ReserveNoGap(1)
+}
+
+// ReserveNoGap reserves count consecutive numbers of a "No Gap" sequence and returns the first one
+func sequence_ReserveNoGap(rs m.SequenceSet, count int64) int64 {
 	rs.EnsureOne()
-	numberNext := rs.NumberNext()
-	rs.Env().Cr().Execute(`SELECT number_next FROM sequence WHERE id=? FOR UPDATE NOWAIT`, rs.ID())
-	rs.Env().Cr().Execute(`UPDATE sequence SET number_next=number_next + ? WHERE id=?`, rs.NumberIncrement(), rs.ID())
+	if count < 1 {
+		panic(rs.T("At least one number must be reserved, got %d", count))
+	}
+	numberNext := lockNoGapRow(rs, "sequence", rs.ID())
+	rs.Env().Cr().Execute(`UPDATE sequence SET number_next=number_next + ? WHERE id=?`, count*rs.NumberIncrement(), rs.ID())
 	rs.Collection().InvalidateCache()
 	return numberNext
 }
 
+// noGapLockRetryDelay is the delay before the first retry of the 'retry' lock strategy
+const noGapLockRetryDelay = 20 * time.Millisecond
+
+// noGapLockStat holds the lock contention statistics of a "No Gap" sequence
+type noGapLockStat struct {
+	Draws     int64
+	Contended int64
+	Failed    int64
+	Waited    time.Duration
+}
+
+// noGapLockStats holds the lock contention statistics of the "No Gap" sequences
+// of this process, indexed by table and id.
+var noGapLockStats = struct {
+	sync.Mutex
+	stats map[string]*noGapLockStat
+}{
+	stats: make(map[string]*noGapLockStat),
+}
+
+// recordNoGapLock updates the contention statistics of the given row and logs them if there was contention.
+func recordNoGapLock(seq m.SequenceSet, table string, id int64, attempts int, waited time.Duration, failed bool) {
+	noGapLockStats.Lock()
+	defer noGapLockStats.Unlock()
+	key := fmt.Sprintf("%s,%d", table, id)
+	stat, ok := noGapLockStats.stats[key]
+	if !ok {
+		stat = new(noGapLockStat)
+		noGapLockStats.stats[key] = stat
+	}
+	stat.Draws++
+	if attempts <= 1 && !failed {
+		return
+	}
+	stat.Contended++
+	stat.Waited += waited
+	logFunc := log.Info
+	if failed {
+		stat.Failed++
+		logFunc = log.Warn
+	}
+	logFunc("Lock contention on no gap sequence", "sequence", seq.Name(), "table", table, "id", id,
+		"strategy", seq.LockStrategy(), "attempts", attempts, "waited", waited, "failed", failed,
+		"draws", stat.Draws, "contended", stat.Contended, "totalFailed", stat.Failed, "totalWaited", stat.Waited)
+}
+
+// lockNoGapRow locks the row with the given id in the given table (sequence or sequence_date_range)
+// according to the lock strategy of seq and returns its number_next.
+//
+// Rows are first tried with SKIP LOCKED so that contention can be detected without aborting the transaction.
+func lockNoGapRow(seq m.SequenceSet, table string, id int64) int64 {
+	cr := seq.Env().Cr()
+	tryLock := func() (int64, bool) {
+		var numbers []int64
+		cr.Select(&numbers, fmt.Sprintf(`SELECT number_next FROM %s WHERE id=? FOR UPDATE SKIP LOCKED`, table), id)
+		if len(numbers) == 0 {
+			return 0, false
+		}
+		return numbers[0], true
+	}
+	busy := func() string {
+		return seq.T("Sequence %s is being used by another transaction, please try again", seq.Name())
+	}
+	start := time.Now()
+	if numberNext, ok := tryLock(); ok {
+		recordNoGapLock(seq, table, id, 1, 0, false)
+		return numberNext
+	}
+	switch seq.LockStrategy() {
+	case "retry":
+		delay := noGapLockRetryDelay
+		for attempt := 1; attempt <= seq.LockRetries(); attempt++ {
+			time.Sleep(delay)
+			delay *= 2
+			if numberNext, ok := tryLock(); ok {
+				recordNoGapLock(seq, table, id, attempt+1, time.Since(start), false)
+				return numberNext
+			}
+		}
+		recordNoGapLock(seq, table, id, seq.LockRetries()+1, time.Since(start), true)
+		panic(busy())
+	case "wait":
+		var previousTimeout, timeout string
+		cr.Get(&previousTimeout, `SELECT current_setting('lock_timeout')`)
+		cr.Get(&timeout, `SELECT set_config('lock_timeout', ?, true)`, fmt.Sprintf("%dms", seq.LockTimeout()))
+		var numberNext int64
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					// The transaction is aborted at this point
+					recordNoGapLock(seq, table, id, 2, time.Since(start), true)
+					log.Warn("Unable to lock no gap sequence", "sequence", seq.Name(), "error", r)
+					panic(busy())
+				}
+			}()
+			cr.Get(&numberNext, fmt.Sprintf(`SELECT number_next FROM %s WHERE id=? FOR UPDATE`, table), id)
+		}()
+		cr.Get(&timeout, `SELECT set_config('lock_timeout', ?, true)`, previousTimeout)
+		recordNoGapLock(seq, table, id, 2, time.Since(start), false)
+		return numberNext
+	default:
+		recordNoGapLock(seq, table, id, 1, 0, true)
+		panic(busy())
+	}
+}
+
+// SequenceState is the exported state of a sequence, as used by ExportStates and ImportStates
+type SequenceState struct {
+	ExternalID      string               `json:"external_id,omitempty"`
+	Code            string               `json:"code,omitempty"`
+	Name            string               `json:"name"`
+	Company         string               `json:"company,omitempty"`
+	Implementation  string               `json:"implementation"`
+	NumberNext      int64                `json:"number_next"`
+	NumberIncrement int64                `json:"number_increment"`
+	DateRanges      []SequenceRangeState `json:"date_ranges,omitempty"`
+}
+
+// SequenceRangeState is the exported state of a sequence date range
+type SequenceRangeState struct {
+	DateFrom   string `json:"date_from"`
+	DateTo     string `json:"date_to"`
+	NumberNext int64  `json:"number_next"`
+}
+
+// repairHexyaSequence reconciles the DB sequence with the given name with the given increment
+// and next number of its record. If direction is "from_db", the next number of the DB sequence
+// is returned to be written on the record. If direction is "to_db", the DB sequence is restarted
+// at numberNext. In both directions, the increment of the record is applied to the DB sequence
+// and missing DB sequences are created. It returns the next number and whether anything changed.
+func repairHexyaSequence(env models.Environment, name string, increment, numberNext int64, direction string) (int64, bool) {
+	hexyaSeq, ok := models.Registry.GetSequence(name)
+	var dbExists bool
+	if ok {
+		env.Cr().Get(&dbExists, `SELECT COUNT(*) > 0 FROM pg_class WHERE relkind = 'S' AND relname = ?`, hexyaSeq.JSON)
+	}
+	if !dbExists {
+		log.Info("Creating missing DB sequence", "sequence", name, "next", numberNext)
+		models.CreateSequence(name, increment, numberNext)
+		return numberNext, true
+	}
+	dbNext := predictHexyaSequence(env, name, numberNext)
+	var dbIncrement int64
+	env.Cr().Get(&dbIncrement, `SELECT increment_by FROM pg_sequences WHERE sequencename = ?`, hexyaSeq.JSON)
+	if dbNext == numberNext && dbIncrement == increment {
+		return numberNext, false
+	}
+	log.Info("Repairing sequence", "sequence", name, "direction", direction, "recordNext", numberNext,
+		"dbNext", dbNext, "recordIncrement", increment, "dbIncrement", dbIncrement)
+	if direction == "from_db" {
+		if dbIncrement != increment {
+			hexyaSeq.Alter(increment, 0)
+		}
+		return dbNext, true
+	}
+	hexyaSeq.Alter(increment, numberNext)
+	return numberNext, true
+}
+
+// sequenceDates returns the current, effective and range dates of a number
+// drawn from a sequence in the given environment.
+func sequenceDates(env models.Environment) (time.Time, time.Time, time.Time) {
+	location, err := time.LoadLocation(env.Context().GetString("tz"))
+	if err != nil {
+		location = time.UTC
+	}
+	now := time.Now().In(location)
+	rangeDate, effectiveDate := now, now
+	if env.Context().HasKey("sequence_date") {
+		effectiveDate = env.Context().GetDate("sequence_date").Time
+	}
+	if env.Context().HasKey("sequence_date_range") {
+		rangeDate = env.Context().GetDate("sequence_date_range").Time
+	}
+	return now, effectiveDate, rangeDate
+}
+
+// sequenceInterpolationMap returns the values of the date keys that can be used
+// in the prefix, suffix and number format of a sequence.
+func sequenceInterpolationMap(env models.Environment) map[string]string {
+	now, effectiveDate, rangeDate := sequenceDates(env)
+	res := make(map[string]string)
+	for key, format := range Sequences {
+		res[key] = effectiveDate.Format(format)
+		res["range_"+key] = rangeDate.Format(format)
+		res["current_"+key] = now.Format(format)
+	}
+	for key, fFunc := range SequenceFuncs {
+		res[key] = fFunc(effectiveDate)
+		res["range_"+key] = fFunc(rangeDate)
+		res["current_"+key] = fFunc(now)
+	}
+	return res
+}
+
 // GetNextChar returns the given number formatted as per the sequence data
 func sequence_GetNextChar(rs m.SequenceSet, numberNext int64) string {
 	interpolate := func(format string, data map[string]string) string {
@@ -190,47 +916,242 @@ func sequence_GetNextChar(rs m.SequenceSet, numberNext int64) string {
 		}
 		return res
 	}
-	interpolateMap := func() map[string]string {
-		location, err := time.LoadLocation(rs.Env().Context().GetString("tz"))
-		if err != nil {
-			location = time.UTC
-		}
-		now := time.Now().In(location)
-		rangeDate, effectiveDate := now, now
-		if rs.Env().Context().HasKey("sequence_date") {
-			effectiveDate = rs.Env().Context().GetDate("sequence_date").Time
+	d := sequenceInterpolationMap(rs.Env())
+	var res string
+	if rs.NumberFormat() != "" {
+		res = rs.FormatNumber(numberNext, d)
+	} else {
+		res = interpolate(rs.Prefix(), d) + rs.PaddedNumber(numberNext) + interpolate(rs.Suffix(), d)
+	}
+	if checkFunc, ok := SequenceCheckDigits[rs.CheckDigit()]; ok && rs.CheckDigitScope() == "full" {
+		res += checkFunc(res)
+	}
+	return res
+}
+
+// CheckInterpolation panics if the prefix or suffix of this sequence contain
+// %(key)s placeholders that are not known interpolation keys.
+func sequence_CheckInterpolation(rs m.SequenceSet) {
+	rs.EnsureOne()
+	if rs.NumberFormat() != "" {
+		return
+	}
+	known := sequenceInterpolationMap(rs.Env())
+	var unknown []string
+	for _, placeholder := range sequencePlaceholderRegex.FindAllString(rs.Prefix()+rs.Suffix(), -1) {
+		if _, ok := known[placeholder[2:len(placeholder)-2]]; !ok {
+			unknown = append(unknown, placeholder)
 		}
-		if rs.Env().Context().HasKey("sequence_date_range") {
-			rangeDate = rs.Env().Context().GetDate("sequence_date_range").Time
+	}
+	if len(unknown) > 0 {
+		panic(rs.T("Unknown interpolation keys in prefix or suffix of sequence %s: %s", rs.Name(), strings.Join(unknown, ", ")))
+	}
+}
+
+// Preview returns the count next numbers of this sequence for the given date,
+// without consuming them. If date is zero, today is used. An empty slice is
+// returned if count is not positive.
+//
+// Numbers are rendered from NumberNextActual of the sequence or of the date range
+// containing date. Date ranges that do not exist yet are not created.
+// It panics if the prefix, suffix or number format of the sequence cannot be interpolated.
+func sequence_Preview(rs m.SequenceSet, count int, date dates.Date) []string {
+	rs.EnsureOne()
+	rs.CheckInterpolation()
+	if count <= 0 {
+		return []string{}
+	}
+	if date.IsZero() {
+		date = dates.Today()
+	}
+	seq := rs.WithContext("sequence_date", date)
+	next := seq.NumberNextActual()
+	if seq.UseDateRange() {
+		dateRange := h.SequenceDateRange().Search(rs.Env(),
+			q.SequenceDateRange().Sequence().Equals(rs).
+				And().DateFrom().LowerOrEqual(date).
+				And().DateTo().GreaterOrEqual(date)).
+			Limit(1)
+		if dateRange.IsEmpty() {
+			dateFrom, _ := seq.GetRangeBounds(date)
+			seq = seq.WithContext("sequence_date_range", dateFrom)
+			next = 1
+		} else {
+			seq = seq.WithContext("sequence_date_range", dateRange.DateFrom())
+			next = dateRange.NumberNextActual()
 		}
+	}
+	res := make([]string, count)
+	for i := range res {
+		res[i] = seq.GetNextChar(next + int64(i)*rs.NumberIncrement())
+	}
+	return res
+}
 
-		res := make(map[string]string)
-		for key, format := range Sequences {
-			res[key] = effectiveDate.Format(format)
-			res["range_"+key] = rangeDate.Format(format)
-			res["current_"+key] = now.Format(format)
+// PaddedNumber returns the given number padded with zeros to the sequence's padding.
+// Check digits are appended if the sequence computes them over the number.
+func sequence_PaddedNumber(rs m.SequenceSet, numberNext int64) string {
+	res := fmt.Sprintf(fmt.Sprintf("%%0%dd", rs.Padding()), numberNext)
+	if alphabet, ok := SequenceNumberings[rs.Numbering()]; ok && rs.Numbering() != "decimal" {
+		res = EncodeNumber(numberNext, alphabet, int(rs.Padding()))
+	}
+	if checkFunc, ok := SequenceCheckDigits[rs.CheckDigit()]; ok && rs.CheckDigitScope() != "full" {
+		res += checkFunc(res)
+	}
+	return res
+}
+
+// NumberingAlphabet returns the digits of the numbering format of this sequence
+func sequence_NumberingAlphabet(rs m.SequenceSet) string {
+	if alphabet, ok := SequenceNumberings[rs.Numbering()]; ok {
+		return alphabet
+	}
+	return SequenceNumberings["decimal"]
+}
+
+// ValidateNumber returns true if the check digits of the given reference are valid
+// for this sequence. It always returns true if the sequence has no check digit.
+//
+// When check digits are computed over the number, the number is located in the reference
+// with the ParseRegex of the sequence, so that prefixes ending with digits are not taken
+// as part of the number. With a NumberFormat template, the number and its check digits are
+// expected to be at the end of the reference, the number being Padding characters long.
+func sequence_ValidateNumber(rs m.SequenceSet, number string) bool {
+	rs.EnsureOne()
+	checkFunc, ok := SequenceCheckDigits[rs.CheckDigit()]
+	if !ok {
+		return true
+	}
+	checkLen := len(checkFunc("0"))
+	if len(number) <= checkLen {
+		return false
+	}
+	if rs.CheckDigitScope() == "full" {
+		return strings.EqualFold(checkFunc(number[:len(number)-checkLen]), number[len(number)-checkLen:])
+	}
+	if rs.NumberFormat() == "" {
+		parseRegex := rs.ParseRegex()
+		match := parseRegex.FindStringSubmatchIndex(number)
+		if match == nil {
+			return false
 		}
-		for key, fFunc := range SequenceFuncs {
-			res[key] = fFunc(effectiveDate)
-			res["range_"+key] = fFunc(rangeDate)
-			res["current_"+key] = fFunc(now)
+		numIndex := subexpIndex(parseRegex, "number")
+		numEnd := match[2*numIndex+1]
+		return strings.EqualFold(checkFunc(number[match[2*numIndex]:numEnd]), number[numEnd:numEnd+checkLen])
+	}
+	check := number[len(number)-checkLen:]
+	payload := number[:len(number)-checkLen]
+	if rs.Padding() > 0 {
+		if len(payload) < int(rs.Padding()) {
+			return false
 		}
-		return res
+		return strings.EqualFold(checkFunc(payload[len(payload)-int(rs.Padding()):]), check)
+	}
+	alphabet := rs.NumberingAlphabet()
+	start := len(payload)
+	for start > 0 && strings.ContainsRune(alphabet, rune(payload[start-1])) {
+		start--
+	}
+	if start == len(payload) {
+		return false
+	}
+	return strings.EqualFold(checkFunc(payload[start:]), check)
+}
+
+// FormatNumber renders the given number with the NumberFormat template of this sequence.
+// data holds the values of the date keys that are available as template functions.
+func sequence_FormatNumber(rs m.SequenceSet, numberNext int64, data map[string]string) string {
+	rs.EnsureOne()
+	funcs := make(template.FuncMap)
+	for key, value := range data {
+		val := value
+		funcs[key] = func() string { return val }
+	}
+	for key, fnct := range SequenceTemplateFuncs {
+		funcs[key] = fnct
+	}
+	tmpl, err := template.New(rs.Name()).Funcs(funcs).Option("missingkey=error").Parse(rs.NumberFormat())
+	if err != nil {
+		panic(rs.T("Invalid number format for sequence %s: %s", rs.Name(), err))
+	}
+	_, effectiveDate, rangeDate := sequenceDates(rs.Env())
+	tmplData := SequenceTemplateData{
+		Number:    numberNext,
+		Padded:    rs.PaddedNumber(numberNext),
+		Record:    rs.TemplateRecord(),
+		Company:   rs.Company(),
+		Sequence:  rs,
+		Date:      effectiveDate,
+		RangeDate: rangeDate,
+	}
+	if tmplData.Company.IsEmpty() {
+		tmplData.Company = h.User().NewSet(rs.Env()).CurrentUser().Company()
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, tmplData); err != nil {
+		panic(rs.T("Unable to format number of sequence %s: %s", rs.Name(), err))
+	}
+	return buf.String()
+}
+
+// WithRecord returns this sequence with the given record in its context,
+// so that it can be referenced as .Record in the NumberFormat template.
+//
+// record must be a RecordSet with a single record. Otherwise it is ignored.
+func sequence_WithRecord(rs m.SequenceSet, record interface{}) m.SequenceSet {
+	rec, ok := record.(models.RecordSet)
+	if !ok || rec.Len() != 1 {
+		return rs
+	}
+	return rs.
+		WithContext("sequence_record_model", rec.ModelName()).
+		WithContext("sequence_record_id", rec.Ids()[0])
+}
+
+// TemplateRecord returns the record set in context by WithRecord, or nil if there is none.
+func sequence_TemplateRecord(rs m.SequenceSet) interface{} {
+	modelName := rs.Env().Context().GetString("sequence_record_model")
+	if modelName == "" {
+		return nil
+	}
+	model, ok := models.Registry.Get(modelName)
+	if !ok {
+		return nil
+	}
+	return model.BrowseOne(rs.Env(), rs.Env().Context().GetInteger("sequence_record_id")).Wrap()
+}
+
+// GetRangeBounds returns the first and last days of the period of this sequence that contains date
+func sequence_GetRangeBounds(rs m.SequenceSet, date dates.Date) (dates.Date, dates.Date) {
+	rs.EnsureOne()
+	day := date.SetDay(date.Day())
+	switch rs.RangePeriod() {
+	case "quarter":
+		dateFrom := day.StartOfMonth().SetMonth((day.Month()-1)/3*3 + 1)
+		return dateFrom, dateFrom.AddDate(0, 3, -1)
+	case "month":
+		dateFrom := day.StartOfMonth()
+		return dateFrom, dateFrom.AddDate(0, 1, -1)
+	case "week":
+		// Weeks start on monday
+		dateFrom := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+		return dateFrom, dateFrom.AddDate(0, 0, 6)
+	case "fiscal_year":
+		company := rs.Company()
+		if company.IsEmpty() {
+			company = h.User().NewSet(rs.Env()).CurrentUser().Company()
+		}
+		return company.FiscalYearBounds(day)
+	default:
+		dateFrom := day.StartOfYear()
+		return dateFrom, dateFrom.AddDate(1, 0, -1)
 	}
-	d := interpolateMap()
-	interpolatedPrefix := interpolate(rs.Prefix(), d)
-	interpolatedSuffix := interpolate(rs.Suffix(), d)
-	return interpolatedPrefix +
-		fmt.Sprintf(fmt.Sprintf("%%0%dd", rs.Padding()), numberNext) +
-		interpolatedSuffix
 }
 
 // CreateDateRangeSeq creates the date range for the given date
 func sequence_CreateDateRangeSeq(rs m.SequenceSet, date dates.Date) m.SequenceDateRangeSet {
 	rs.EnsureOne()
-	year := date.Year()
-	dateFrom := dates.ParseDate(fmt.Sprintf("%d-01-01", year))
-	dateTo := dates.ParseDate(fmt.Sprintf("%d-12-31", year))
+	dateFrom, dateTo := rs.GetRangeBounds(date)
 	dateRange := h.SequenceDateRange().Search(rs.Env(),
 		q.SequenceDateRange().Sequence().Equals(rs).
 			And().DateFrom().GreaterOrEqual(date).
@@ -247,7 +1168,7 @@ func sequence_CreateDateRangeSeq(rs m.SequenceSet, date dates.Date) m.SequenceDa
 		OrderBy("DateTo DESC").
 		Limit(1)
 	if !dateRange.IsEmpty() {
-		dateTo = dateRange.DateTo().AddDate(0, 0, 1)
+		dateFrom = dateRange.DateTo().AddDate(0, 0, 1)
 	}
 	seqDateRange := h.SequenceDateRange().NewSet(rs.Env()).Sudo().Create(h.SequenceDateRange().NewData().
 		SetDateFrom(dateFrom).
@@ -256,13 +1177,10 @@ func sequence_CreateDateRangeSeq(rs m.SequenceSet, date dates.Date) m.SequenceDa
 	return seqDateRange
 }
 
-// Next returns the next number (formatted) in the preferred sequence in all the ones given in self
-func sequence_Next(rs m.SequenceSet) string {
+// CurrentDateRange returns the date range of this sequence for the 'sequence_date' in
+// context or today. The date range is created if it does not exist.
+func sequence_CurrentDateRange(rs m.SequenceSet) m.SequenceDateRangeSet {
 	rs.EnsureOne()
-	if !rs.UseDateRange() {
-		return rs.NextDo()
-	}
-	// Date mode
 	dt := dates.Today()
 	if rs.Env().Context().HasKey("sequence_date") {
 		dt = rs.Env().Context().GetDate("sequence_date")
@@ -275,7 +1193,30 @@ func sequence_Next(rs m.SequenceSet) string {
 	if seqDate.IsEmpty() {
 		seqDate = rs.CreateDateRangeSeq(dt)
 	}
-	return seqDate.WithContext("sequence_date_range", seqDate.DateFrom()).Next()
+	return seqDate.WithContext("sequence_date_range", seqDate.DateFrom())
+}
+
+// Next returns the next number (formatted) in the preferred sequence in all the ones given in self
+func sequence_Next(rs m.SequenceSet) string {
+	rs.EnsureOne()
+	if !rs.UseDateRange() {
+		return rs.NextDo()
+	}
+	return rs.CurrentDateRange().Next()
+}
+
+// NextN returns the count next numbers (formatted) of this sequence.
+// The numbers are reserved atomically as a contiguous block, which is much
+// faster than calling Next count times.
+func sequence_NextN(rs m.SequenceSet, count int) []string {
+	rs.EnsureOne()
+	if count <= 0 {
+		return []string{}
+	}
+	if !rs.UseDateRange() {
+		return rs.NextNDo(count)
+	}
+	return rs.CurrentDateRange().NextN(count)
 }
 
 // NextByID draws an interpolated string using the specified sequence.
@@ -291,13 +1232,23 @@ func sequence_NextByID(rs m.SequenceSet) string {
 // The context may contain a 'force_company' key with the ID of the company to
 // use instead of the user's current company for the sequence selection.
 // A matching sequence for that specific company will get higher priority
+//
+// In strict mode, it panics instead of returning "False" if no sequence is found, and it
+// only falls back on a sequence without company if there is none for the company.
+// Strict mode is enabled by the 'sequence_strict' context key or by setting the
+// 'sequence.strict' configuration parameter to "True".
 func sequence_NextByCode(rs m.SequenceSet, sequenceCode string) string {
 	rs.CheckExecutionPermission(h.Sequence().Methods().Read().Underlying())
+	strict := rs.Env().Context().GetBool("sequence_strict") ||
+		h.ConfigParameter().NewSet(rs.Env()).Sudo().GetParam("sequence.strict", "False") == "True"
 	companies := h.Company().NewSet(rs.Env()).SearchAll()
 	seqs := h.Sequence().Search(rs.Env(),
 		q.Sequence().Code().Equals(sequenceCode).AndCond(
 			q.Sequence().Company().In(companies).Or().Company().IsNull()))
 	if seqs.IsEmpty() {
+		if strict {
+			panic(rs.T("No sequence has been found for code %s", sequenceCode))
+		}
 		log.Debug("No Sequence has been found for this code", "code", sequenceCode, "companies", companies)
 		return "False"
 	}
@@ -310,9 +1261,150 @@ func sequence_NextByCode(rs m.SequenceSet, sequenceCode string) string {
 			return seq.Next()
 		}
 	}
+	if strict {
+		for _, seq := range seqs.Records() {
+			if seq.Company().IsEmpty() {
+				return seq.Next()
+			}
+		}
+		panic(rs.T("No sequence has been found for code %s and company %d", sequenceCode, forceCompanyID))
+	}
 	return seqs.Records()[0].Next()
 }
 
+// Repair reconciles the standard sequences of this set and their date ranges with the DB
+// sequences that hold their real counters. If direction is "from_db", the next numbers of the
+// records are updated from the DB sequences. If direction is "to_db", the DB sequences are
+// restarted at the next numbers of the records. It returns the number of repaired counters.
+func sequence_Repair(rs m.SequenceSet, direction string) int {
+	if direction != "from_db" && direction != "to_db" {
+		panic(rs.T("Unknown repair direction %s", direction))
+	}
+	var res int
+	for _, seq := range rs.Records() {
+		if seq.Implementation() != "standard" {
+			continue
+		}
+		next, changed := repairHexyaSequence(rs.Env(), fmt.Sprintf("sequence_%03d", seq.ID()),
+			seq.NumberIncrement(), seq.NumberNext(), direction)
+		if changed {
+			res++
+			if next != seq.NumberNext() {
+				rs.Env().Cr().Execute(`UPDATE sequence SET number_next = ? WHERE id = ?`, next, seq.ID())
+			}
+		}
+		for _, dateRange := range seq.DateRanges().Records() {
+			next, changed := repairHexyaSequence(rs.Env(), fmt.Sprintf("sequence_%03d_%03d", seq.ID(), dateRange.ID()),
+				seq.NumberIncrement(), dateRange.NumberNext(), direction)
+			if changed {
+				res++
+				if next != dateRange.NumberNext() {
+					rs.Env().Cr().Execute(`UPDATE sequence_date_range SET number_next = ? WHERE id = ?`, next, dateRange.ID())
+				}
+			}
+		}
+	}
+	rs.Collection().InvalidateCache()
+	return res
+}
+
+// ExportStates returns the JSON encoded states of the sequences of this set,
+// with their actual next numbers and those of their date ranges.
+func sequence_ExportStates(rs m.SequenceSet) string {
+	states := make([]SequenceState, 0, rs.Len())
+	for _, seq := range rs.Records() {
+		state := SequenceState{
+			ExternalID:      seq.HexyaExternalID(),
+			Code:            seq.Code(),
+			Name:            seq.Name(),
+			Company:         seq.Company().Name(),
+			Implementation:  seq.Implementation(),
+			NumberNext:      seq.NumberNextActual(),
+			NumberIncrement: seq.NumberIncrement(),
+		}
+		for _, dateRange := range seq.DateRanges().Records() {
+			state.DateRanges = append(state.DateRanges, SequenceRangeState{
+				DateFrom:   dateRange.DateFrom().String(),
+				DateTo:     dateRange.DateTo().String(),
+				NumberNext: dateRange.NumberNextActual(),
+			})
+		}
+		states = append(states, state)
+	}
+	res, err := json.MarshalIndent(states, "", "  ")
+	if err != nil {
+		panic(fmt.Errorf("unable to marshal sequence states: %s", err))
+	}
+	return string(res)
+}
+
+// ImportStates sets the next numbers of sequences and of their date ranges from the
+// given JSON data as returned by ExportStates. Sequences are matched by external ID,
+// or by code and company name. Missing date ranges are created.
+// It returns the number of updated sequences.
+func sequence_ImportStates(rs m.SequenceSet, data string) int {
+	var states []SequenceState
+	if err := json.Unmarshal([]byte(data), &states); err != nil {
+		panic(rs.T("Unable to read sequence states: %s", err))
+	}
+	var res int
+	for _, state := range states {
+		var seq m.SequenceSet
+		if state.ExternalID != "" {
+			seq = h.Sequence().Search(rs.Env(), q.Sequence().HexyaExternalID().Equals(state.ExternalID))
+		}
+		if (seq == nil || seq.IsEmpty()) && state.Code != "" {
+			seq = h.Sequence().Search(rs.Env(), q.Sequence().Code().Equals(state.Code)).
+				Filtered(func(r m.SequenceSet) bool {
+					return r.Company().Name() == state.Company
+				})
+		}
+		if seq == nil || seq.Len() != 1 {
+			log.Warn("Unable to find sequence to import state", "externalID", state.ExternalID,
+				"code", state.Code, "company", state.Company)
+			continue
+		}
+		seq.SetNumberNextActual(state.NumberNext)
+		for _, rangeState := range state.DateRanges {
+			dateFrom := dates.ParseDate(rangeState.DateFrom)
+			dateRange := h.SequenceDateRange().Search(rs.Env(),
+				q.SequenceDateRange().Sequence().Equals(seq).
+					And().DateFrom().Equals(dateFrom))
+			if dateRange.IsEmpty() {
+				h.SequenceDateRange().Create(rs.Env(), h.SequenceDateRange().NewData().
+					SetSequence(seq).
+					SetDateFrom(dateFrom).
+					SetDateTo(dates.ParseDate(rangeState.DateTo)).
+					SetNumberNextActual(rangeState.NumberNext))
+				continue
+			}
+			dateRange.SetNumberNextActual(rangeState.NumberNext)
+		}
+		res++
+	}
+	return res
+}
+
+// ProvisionCompany creates a copy of each sequence of this set for the given company,
+// unless the company already has a sequence with the same code.
+// The copies start again from the first number and are not templates themselves.
+func sequence_ProvisionCompany(rs m.SequenceSet, company m.CompanySet) m.SequenceSet {
+	company.EnsureOne()
+	res := h.Sequence().NewSet(rs.Env())
+	for _, seq := range rs.Records() {
+		if seq.Code() != "" && !h.Sequence().Search(rs.Env(),
+			q.Sequence().Code().Equals(seq.Code()).And().Company().Equals(company)).IsEmpty() {
+			continue
+		}
+		res = res.Union(seq.Copy(h.Sequence().NewData().
+			SetName(seq.Name()).
+			SetCompany(company).
+			SetNumberNext(1).
+			SetDateRanges(h.SequenceDateRange().NewSet(rs.Env()))))
+	}
+	return res
+}
+
 var fields_SequenceDateRange = map[string]models.FieldDefinition{
 	"DateFrom": fields.Date{String: "From", Required: true},
 	"DateTo":   fields.Date{String: "To", Required: true},
@@ -329,7 +1421,11 @@ var fields_SequenceDateRange = map[string]models.FieldDefinition{
 
 // ComputeNumberNextActual returns the real next number for the sequence depending on the implementation
 func sequenceDateRange_ComputeNumberNextActual(rs m.SequenceDateRangeSet) m.SequenceDateRangeData {
-	res := h.SequenceDateRange().NewData().SetNumberNextActual(rs.NumberNext())
+	next := rs.NumberNext()
+	if rs.Sequence().Implementation() == "standard" && rs.ID() != 0 {
+		next = predictHexyaSequence(rs.Env(), fmt.Sprintf("sequence_%03d_%03d", rs.Sequence().ID(), rs.ID()), next)
+	}
+	res := h.SequenceDateRange().NewData().SetNumberNextActual(next)
 	return res
 }
 
@@ -350,6 +1446,27 @@ func sequenceDateRange_Next(rs m.SequenceDateRangeSet) string {
 	return rs.Sequence().GetNextChar(rs.UpdateNoGap())
 }
 
+// NextN returns the count next numbers (formatted) of this sequence date range.
+// The numbers are reserved as a single contiguous block.
+func sequenceDateRange_NextN(rs m.SequenceDateRangeSet, count int) []string {
+	rs.EnsureOne()
+	if count <= 0 {
+		return []string{}
+	}
+	var first int64
+	if rs.Sequence().Implementation() == "standard" {
+		hexyaSeq := models.Registry.MustGetSequence(fmt.Sprintf("sequence_%03d_%03d", rs.Sequence().ID(), rs.ID()))
+		first = reserveHexyaSequence(hexyaSeq, int64(count))
+	} else {
+		first = rs.ReserveNoGap(int64(count))
+	}
+	res := make([]string, count)
+	for i := range res {
+		res[i] = rs.Sequence().GetNextChar(first + int64(i)*rs.Sequence().NumberIncrement())
+	}
+	return res
+}
+
 // AlterHexyaSequence alters the date range sequences in one go
 func sequenceDateRange_AlterHexyaSequence(rs m.SequenceDateRangeSet, numberIncrement int64, numberNext int64) {
 	for _, seq := range rs.Records() {
@@ -394,7 +1511,7 @@ func sequenceDateRange_Write(rs m.SequenceDateRangeSet, data m.SequenceDateRange
 		for _, rec := range seqToAlter.Records() {
 			hexyaSeq, exists := models.Registry.GetSequence(fmt.Sprintf("sequence_%03d_%03d", rec.Sequence().ID(), rec.ID()))
 			if exists {
-				hexyaSeq.Alter(data.NumberNext(), 0)
+				hexyaSeq.Alter(0, data.NumberNext())
 			}
 		}
 	}
@@ -403,10 +1520,17 @@ func sequenceDateRange_Write(rs m.SequenceDateRangeSet, data m.SequenceDateRange
 
 // UpdateNoGap gets the next number of a "No Gap" sequence
 func sequenceDateRange_UpdateNoGap(rs m.SequenceDateRangeSet) int64 {
+	return rs.ReserveNoGap(1)
+}
+
+// ReserveNoGap reserves count consecutive numbers of a "No Gap" sequence and returns the first one
+func sequenceDateRange_ReserveNoGap(rs m.SequenceDateRangeSet, count int64) int64 {
 	rs.EnsureOne()
-	numberNext := rs.NumberNext()
-	rs.Env().Cr().Execute(`SELECT number_next FROM sequence_date_range WHERE id=? FOR UPDATE NOWAIT`, rs.ID())
-	rs.Env().Cr().Execute(`UPDATE sequence_date_range SET number_next=number_next + ? WHERE id=?`, rs.Sequence().NumberIncrement(), rs.ID())
+	if count < 1 {
+		panic(rs.T("At least one number must be reserved, got %d", count))
+	}
+	numberNext := lockNoGapRow(rs.Sequence(), "sequence_date_range", rs.ID())
+	rs.Env().Cr().Execute(`UPDATE sequence_date_range SET number_next=number_next + ? WHERE id=?`, count*rs.Sequence().NumberIncrement(), rs.ID())
 	rs.Collection().InvalidateCache()
 	return numberNext
 }
@@ -423,22 +1547,46 @@ func init() {
 	h.Sequence().Methods().Unlink().Extend(sequence_Unlink)
 	h.Sequence().Methods().Write().Extend(sequence_Write)
 	h.Sequence().NewMethod("NextDo", sequence_NextDo)
+	h.Sequence().NewMethod("NextNDo", sequence_NextNDo)
 	h.Sequence().NewMethod("UpdateNoGap", sequence_UpdateNoGap)
+	h.Sequence().NewMethod("ReserveNoGap", sequence_ReserveNoGap)
 	h.Sequence().NewMethod("GetNextChar", sequence_GetNextChar)
+	h.Sequence().NewMethod("PaddedNumber", sequence_PaddedNumber)
+	h.Sequence().NewMethod("NumberingAlphabet", sequence_NumberingAlphabet)
+	h.Sequence().NewMethod("CheckInterpolation", sequence_CheckInterpolation)
+	h.Sequence().NewMethod("Preview", sequence_Preview)
+	h.Sequence().NewMethod("ParseRegex", sequence_ParseRegex)
+	h.Sequence().NewMethod("Audit", sequence_Audit)
+	h.Sequence().NewMethod("ValidateNumber", sequence_ValidateNumber)
+	h.Sequence().NewMethod("FormatNumber", sequence_FormatNumber)
+	h.Sequence().NewMethod("WithRecord", sequence_WithRecord)
+	h.Sequence().NewMethod("TemplateRecord", sequence_TemplateRecord)
+	h.Sequence().NewMethod("GetRangeBounds", sequence_GetRangeBounds)
 	h.Sequence().NewMethod("CreateDateRangeSeq", sequence_CreateDateRangeSeq)
+	h.Sequence().NewMethod("CurrentDateRange", sequence_CurrentDateRange)
 	h.Sequence().NewMethod("Next", sequence_Next)
+	h.Sequence().NewMethod("NextN", sequence_NextN)
 	h.Sequence().NewMethod("NextByID", sequence_NextByID)
 	h.Sequence().NewMethod("NextByCode", sequence_NextByCode)
+	h.Sequence().NewMethod("ProvisionCompany", sequence_ProvisionCompany)
+	h.Sequence().NewMethod("Repair", sequence_Repair)
+	h.Sequence().NewMethod("ExportStates", sequence_ExportStates)
+	h.Sequence().NewMethod("ImportStates", sequence_ImportStates)
 
 	models.NewModel("SequenceDateRange")
 	h.SequenceDateRange().AddFields(fields_SequenceDateRange)
 
+	models.NewTransientModel("SequenceAuditLine")
+	h.SequenceAuditLine().AddFields(fields_SequenceAuditLine)
+
 	h.SequenceDateRange().NewMethod("ComputeNumberNextActual", sequenceDateRange_ComputeNumberNextActual)
 	h.SequenceDateRange().NewMethod("InverseNumberNextActual", sequenceDateRange_InverseNumberNextActual)
 	h.SequenceDateRange().NewMethod("Next", sequenceDateRange_Next)
+	h.SequenceDateRange().NewMethod("NextN", sequenceDateRange_NextN)
 	h.SequenceDateRange().NewMethod("AlterHexyaSequence", sequenceDateRange_AlterHexyaSequence)
 	h.SequenceDateRange().Methods().Create().Extend(sequenceDateRange_Create)
 	h.SequenceDateRange().Methods().Unlink().Extend(sequenceDateRange_Unlink)
 	h.SequenceDateRange().Methods().Write().Extend(sequenceDateRange_Write)
 	h.SequenceDateRange().NewMethod("UpdateNoGap", sequenceDateRange_UpdateNoGap)
+	h.SequenceDateRange().NewMethod("ReserveNoGap", sequenceDateRange_ReserveNoGap)
 }
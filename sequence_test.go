@@ -11,6 +11,7 @@ import (
 	"github.com/hexya-erp/hexya/src/models/security"
 	"github.com/hexya-erp/hexya/src/models/types/dates"
 	"github.com/hexya-erp/pool/h"
+	"github.com/hexya-erp/pool/m"
 	"github.com/hexya-erp/pool/q"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -311,3 +312,494 @@ func TestSequenceDateRangeChangeImplementation(t *testing.T) {
 		}), ShouldBeNil)
 	})
 }
+
+func TestSequenceNumberFormat(t *testing.T) {
+	Convey("Testing sequences with a number format template", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			date := dates.ParseDate("2019-03-15")
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test format sequence").
+				SetImplementation("no_gap").
+				SetPadding(5).
+				SetNumberFormat("INV/{{.Company.Code}}/{{year}}/{{.Padded}}"))
+			seq.Company().SetCode("MC")
+			Convey("Company and date keys should be rendered", func() {
+				n := seq.WithContext("sequence_date", date).Next()
+				So(n, ShouldEqual, "INV/MC/2019/00001")
+			})
+			Convey("Record and helpers should be rendered", func() {
+				seq.SetNumberFormat(`{{upper .Record.Name}}-{{pad .Number 3}}-{{formatDate .Date "Jan"}}`)
+				partner := h.Partner().Create(env, h.Partner().NewData().SetName("Agrolait"))
+				n := seq.WithContext("sequence_date", date).WithRecord(partner).Next()
+				So(n, ShouldEqual, "AGROLAIT-001-Mar")
+			})
+			Convey("Invalid templates should panic", func() {
+				seq.SetNumberFormat("{{.Unknown}}")
+				So(func() { seq.Next() }, ShouldPanic)
+				seq.SetNumberFormat("{{year")
+				So(func() { seq.Next() }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceDateRangePeriods(t *testing.T) {
+	Convey("Testing date range periods of sequences", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test period sequence").
+				SetImplementation("no_gap").
+				SetUseDateRange(true))
+			date := dates.ParseDate("2019-05-17")
+			checkBounds := func(from, to string) {
+				dateFrom, dateTo := seq.GetRangeBounds(date)
+				So(dateFrom.Equal(dates.ParseDate(from)), ShouldBeTrue)
+				So(dateTo.Equal(dates.ParseDate(to)), ShouldBeTrue)
+			}
+			Convey("Yearly periods", func() {
+				checkBounds("2019-01-01", "2019-12-31")
+			})
+			Convey("Quarterly periods", func() {
+				seq.SetRangePeriod("quarter")
+				checkBounds("2019-04-01", "2019-06-30")
+			})
+			Convey("Monthly periods", func() {
+				seq.SetRangePeriod("month")
+				checkBounds("2019-05-01", "2019-05-31")
+			})
+			Convey("Weekly periods", func() {
+				seq.SetRangePeriod("week")
+				checkBounds("2019-05-13", "2019-05-19")
+			})
+			Convey("Fiscal year periods", func() {
+				seq.SetRangePeriod("fiscal_year")
+				seq.Company().Write(h.Company().NewData().
+					SetFiscalYearLastDay(31).
+					SetFiscalYearLastMonth("3"))
+				checkBounds("2019-04-01", "2020-03-31")
+				seq.Company().SetFiscalYearLastMonth("2")
+				seq.Company().SetFiscalYearLastDay(31)
+				date = dates.ParseDate("2020-01-10")
+				checkBounds("2019-03-01", "2020-02-29")
+			})
+			Convey("Drawing numbers should create monthly subsequences", func() {
+				seq.SetRangePeriod("month")
+				So(seq.WithContext("sequence_date", date).Next(), ShouldEqual, "1")
+				So(seq.WithContext("sequence_date", date.AddDate(0, 0, 1)).Next(), ShouldEqual, "2")
+				So(seq.WithContext("sequence_date", date.AddDate(0, 1, 0)).Next(), ShouldEqual, "1")
+				So(seq.DateRanges().Len(), ShouldEqual, 2)
+				juneRange := seq.DateRanges().Filtered(func(r m.SequenceDateRangeSet) bool {
+					return r.DateFrom().Equal(dates.ParseDate("2019-06-01"))
+				})
+				So(juneRange.DateTo().Equal(dates.ParseDate("2019-06-30")), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceNextN(t *testing.T) {
+	Convey("Testing bulk reservation of sequence numbers", t, func() {
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			Convey("Create a standard sequence", func() {
+				seq := h.Sequence().Create(env, h.Sequence().NewData().
+					SetCode("test_sequence_type_7").
+					SetName("Test bulk sequence").
+					SetNumberIncrement(2).
+					SetPrefix("B"))
+				So(seq.IsEmpty(), ShouldBeFalse)
+			})
+			Convey("Reserving numbers of a fresh standard sequence", func() {
+				seq := h.Sequence().Search(env, q.Sequence().Code().Equals("test_sequence_type_7"))
+				So(seq.NextN(3), ShouldResemble, []string{"B1", "B3", "B5"})
+				So(seq.Next(), ShouldEqual, "B7")
+				So(seq.NextN(2), ShouldResemble, []string{"B9", "B11"})
+				So(seq.NextN(0), ShouldBeEmpty)
+				So(seq.NextNDo(0), ShouldBeEmpty)
+				So(seq.NextNDo(-2), ShouldBeEmpty)
+				So(seq.Next(), ShouldEqual, "B13")
+			})
+		}), ShouldBeNil)
+	})
+	dropSequence("test_sequence_type_7")
+	Convey("Testing bulk reservation of no gap sequence numbers", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test bulk no gap sequence").
+				SetImplementation("no_gap").
+				SetPadding(3))
+			Convey("Reserving numbers without date range", func() {
+				So(seq.NextN(3), ShouldResemble, []string{"001", "002", "003"})
+				So(seq.Next(), ShouldEqual, "004")
+				So(seq.NumberNext(), ShouldEqual, 5)
+				So(seq.NextNDo(-1), ShouldBeEmpty)
+				So(func() { seq.ReserveNoGap(-1) }, ShouldPanic)
+				So(seq.NumberNext(), ShouldEqual, 5)
+			})
+			Convey("Reserving numbers with date ranges", func() {
+				seq.SetUseDateRange(true)
+				date := dates.ParseDate("2019-05-17")
+				So(seq.WithContext("sequence_date", date).NextN(2), ShouldResemble, []string{"001", "002"})
+				So(seq.WithContext("sequence_date", date).Next(), ShouldEqual, "003")
+				So(seq.WithContext("sequence_date", date.AddDate(1, 0, 0)).NextN(2), ShouldResemble, []string{"001", "002"})
+				So(seq.DateRanges().Len(), ShouldEqual, 2)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceCheckDigits(t *testing.T) {
+	Convey("Testing check digit algorithms", t, func() {
+		So(LuhnCheckDigit("7992739871"), ShouldEqual, "3")
+		So(Mod97CheckDigits("794"), ShouldEqual, "44")
+		So(Mod11CheckDigit("000000021825009"), ShouldEqual, "7")
+		So(Mod11CheckDigit("000000021694233"), ShouldEqual, "X")
+		So(LuhnCheckDigit("A-1"), ShouldEqual, LuhnCheckDigit("101"))
+	})
+	Convey("Testing sequences with check digits", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test check digit sequence").
+				SetImplementation("no_gap").
+				SetPrefix("CU").
+				SetSuffix("/%(year)s").
+				SetPadding(5).
+				SetCheckDigit("luhn"))
+			date := dates.ParseDate("2019-03-15")
+			Convey("Check digits over the padded number", func() {
+				n := seq.WithContext("sequence_date", date).Next()
+				So(n, ShouldEqual, "CU000018/2019")
+				So(seq.ValidateNumber(n), ShouldBeTrue)
+				So(seq.ValidateNumber("CU000017/2019"), ShouldBeFalse)
+				So(seq.ValidateNumber("CU000018"), ShouldBeFalse)
+			})
+			Convey("Check digits after a prefix ending with digits", func() {
+				seq.SetPrefix("INV%(y)s")
+				seq.SetSuffix("")
+				seq.SetPadding(4)
+				n := seq.WithContext("sequence_date", dates.ParseDate("2020-03-15")).Next()
+				So(n, ShouldEqual, "INV200001"+LuhnCheckDigit("0001"))
+				So(seq.ValidateNumber(n), ShouldBeTrue)
+				So(seq.ValidateNumber("INV200042"+LuhnCheckDigit("0042")), ShouldBeTrue)
+				So(seq.ValidateNumber("INV200042"+LuhnCheckDigit("200042")), ShouldBeFalse)
+			})
+			Convey("Check digits over the full reference", func() {
+				seq.SetCheckDigit("mod97")
+				seq.SetCheckDigitScope("full")
+				n := seq.WithContext("sequence_date", date).Next()
+				So(n, ShouldEqual, "CU00001/2019"+Mod97CheckDigits("CU00001/2019"))
+				So(seq.ValidateNumber(n), ShouldBeTrue)
+				So(seq.ValidateNumber("CU00002/2019"+Mod97CheckDigits("CU00001/2019")), ShouldBeFalse)
+			})
+			Convey("Check digits in a number format template", func() {
+				seq.SetCheckDigit("mod11")
+				seq.SetNumberFormat("REF-{{.Padded}}")
+				n := seq.Next()
+				So(n, ShouldEqual, "REF-00001"+Mod11CheckDigit("00001"))
+				So(seq.ValidateNumber(n), ShouldBeTrue)
+			})
+			Convey("Sequences without check digit accept any number", func() {
+				seq.SetCheckDigit("")
+				So(seq.ValidateNumber("anything"), ShouldBeTrue)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequencePreview(t *testing.T) {
+	Convey("Testing sequence previews", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test preview sequence").
+				SetImplementation("no_gap").
+				SetPrefix("%(year)s/").
+				SetPadding(3))
+			date := dates.ParseDate("2019-03-15")
+			Convey("Previewing should not consume numbers", func() {
+				So(seq.Preview(3, date), ShouldResemble, []string{"2019/001", "2019/002", "2019/003"})
+				So(seq.NumberNext(), ShouldEqual, 1)
+				So(seq.WithContext("sequence_date", date).Next(), ShouldEqual, "2019/001")
+				So(seq.Preview(1, date), ShouldResemble, []string{"2019/002"})
+				So(seq.Preview(0, date), ShouldBeEmpty)
+				So(seq.Preview(-1, date), ShouldBeEmpty)
+			})
+			Convey("Previewing date ranges should not create them", func() {
+				seq.SetUseDateRange(true)
+				seq.SetPrefix("%(range_year)s/")
+				So(seq.Preview(2, date), ShouldResemble, []string{"2019/001", "2019/002"})
+				So(seq.DateRanges().IsEmpty(), ShouldBeTrue)
+				seq.WithContext("sequence_date", date).Next()
+				So(seq.Preview(1, date), ShouldResemble, []string{"2019/002"})
+				So(seq.Preview(1, date.AddDate(1, 0, 0)), ShouldResemble, []string{"2020/001"})
+			})
+			Convey("Unknown keys should be reported", func() {
+				seq.SetPrefix("%(year)s/%(foo)s/")
+				So(func() { seq.Preview(1, date) }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceAudit(t *testing.T) {
+	Convey("Testing sequence gap audits", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test audit sequence").
+				SetImplementation("no_gap").
+				SetPrefix("AUD/%(range_year)s/").
+				SetPadding(3).
+				SetUseDateRange(true))
+			date2019 := dates.ParseDate("2019-03-15")
+			date2020 := dates.ParseDate("2020-03-15")
+			seq.WithContext("sequence_date", date2019).NextN(1)
+			seq.WithContext("sequence_date", date2020).NextN(1)
+			for _, ref := range []string{"AUD/2019/001", "AUD/2019/003", "AUD/2019/002", "AUD/2019/003",
+				"AUD/2019/005", "AUD/2020/002", "XYZ-12"} {
+				h.Partner().Create(env, h.Partner().NewData().SetName("Audit "+ref).SetRef(ref))
+			}
+			lines := seq.Audit("Partner", "Ref")
+			issues := make(map[string][]int64)
+			var unparsed []string
+			for _, line := range lines.Records() {
+				issues[line.Issue()+" "+line.Series()] = append(issues[line.Issue()+" "+line.Series()], line.Number())
+				if line.Issue() == "unparsed" {
+					unparsed = append(unparsed, line.Reference())
+				}
+			}
+			So(issues["out_of_order AUD/2019/#"], ShouldResemble, []int64{2})
+			So(issues["duplicate AUD/2019/#"], ShouldResemble, []int64{3})
+			So(issues["missing AUD/2019/#"], ShouldResemble, []int64{4})
+			So(issues["missing AUD/2020/#"], ShouldResemble, []int64{1})
+			So(unparsed, ShouldContain, "XYZ-12")
+			for _, line := range lines.Records() {
+				if line.Series() == "AUD/2020/#" {
+					So(line.DateRange().DateFrom().Equal(dates.ParseDate("2020-01-01")), ShouldBeTrue)
+				}
+			}
+			So(func() { seq.Audit("NonExistentModel", "Ref") }, ShouldPanic)
+			seq.SetNumberIncrement(0)
+			So(func() { seq.Audit("Partner", "Ref") }, ShouldPanic)
+		}), ShouldBeNil)
+	})
+	Convey("Testing audits of numbers wider than their padding", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test wide audit sequence").
+				SetImplementation("no_gap").
+				SetPrefix("INV%(year)s%(month)s").
+				SetPadding(2))
+			So(seq.ParseRegex().FindStringSubmatch("INV201903100"), ShouldResemble, []string{"INV201903100", "2019", "03", "100"})
+			for _, ref := range []string{"INV20190399", "INV201903100", "INV201903102"} {
+				h.Partner().Create(env, h.Partner().NewData().SetName("Audit "+ref).SetRef(ref))
+			}
+			lines := seq.Audit("Partner", "Ref")
+			So(lines.Len(), ShouldEqual, 1)
+			So(lines.Issue(), ShouldEqual, "missing")
+			So(lines.Series(), ShouldEqual, "INV201903#")
+			So(lines.Number(), ShouldEqual, 101)
+			seq.SetPadding(0)
+			So(seq.ParseRegex().MatchString("INV201903"), ShouldBeFalse)
+			So(seq.ParseRegex().MatchString("INV2019037"), ShouldBeTrue)
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceNoGapLocking(t *testing.T) {
+	Convey("Testing lock strategies of no gap sequences", t, func() {
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			Convey("Create a no gap sequence", func() {
+				seq := h.Sequence().Create(env, h.Sequence().NewData().
+					SetCode("test_sequence_type_8").
+					SetName("Test lock sequence").
+					SetImplementation("no_gap"))
+				So(seq.LockStrategy(), ShouldEqual, "wait")
+			})
+			checkStrategy := func(strategy string) {
+				models.ExecuteInNewEnvironment(security.SuperUserID, func(env3 models.Environment) {
+					h.Sequence().Search(env3, q.Sequence().Code().Equals("test_sequence_type_8")).
+						Write(h.Sequence().NewData().
+							SetLockStrategy(strategy).
+							SetLockRetries(2).
+							SetLockTimeout(100))
+				})
+				seq := h.Sequence().Search(env, q.Sequence().Code().Equals("test_sequence_type_8"))
+				seq.Next()
+				key := fmt.Sprintf("sequence,%d", seq.ID())
+				noGapLockStats.Lock()
+				var before noGapLockStat
+				if stat, ok := noGapLockStats.stats[key]; ok {
+					before = *stat
+				}
+				noGapLockStats.Unlock()
+				err := models.ExecuteInNewEnvironment(security.SuperUserID, func(env2 models.Environment) {
+					h.Sequence().NewSet(env2).NextByCode("test_sequence_type_8")
+				})
+				So(err, ShouldNotBeNil)
+				noGapLockStats.Lock()
+				after := *noGapLockStats.stats[key]
+				noGapLockStats.Unlock()
+				So(after.Contended, ShouldEqual, before.Contended+1)
+				So(after.Failed, ShouldEqual, before.Failed+1)
+			}
+			Convey("Concurrent draws with the retry strategy should fail after retries", func() {
+				checkStrategy("retry")
+			})
+			Convey("Concurrent draws with the wait strategy should fail after the timeout", func() {
+				checkStrategy("wait")
+			})
+			Convey("Concurrent draws with the nowait strategy should fail immediately", func() {
+				checkStrategy("nowait")
+			})
+		}), ShouldBeNil)
+	})
+	dropSequence("test_sequence_type_8")
+}
+
+func TestSequenceCompanyProvisioning(t *testing.T) {
+	Convey("Testing per company sequences", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			template := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test template sequence").
+				SetCode("test_sequence_template").
+				SetImplementation("no_gap").
+				SetPrefix("TPL/").
+				SetCompany(h.Company().NewSet(env)).
+				SetCompanyTemplate(true))
+			template.Next()
+			Convey("New companies should get a copy of template sequences", func() {
+				company := h.Company().Create(env, h.Company().NewData().SetName("Provisioned Company"))
+				seq := h.Sequence().Search(env,
+					q.Sequence().Code().Equals("test_sequence_template").And().Company().Equals(company))
+				So(seq.Len(), ShouldEqual, 1)
+				So(seq.CompanyTemplate(), ShouldBeFalse)
+				So(seq.Prefix(), ShouldEqual, "TPL/")
+				So(seq.NumberNext(), ShouldEqual, 1)
+				So(h.Sequence().NewSet(env).WithContext("force_company", company.ID()).
+					NextByCode("test_sequence_template"), ShouldEqual, "TPL/1")
+				Convey("Provisioning twice should not duplicate sequences", func() {
+					So(template.ProvisionCompany(company).IsEmpty(), ShouldBeTrue)
+				})
+			})
+			Convey("Strict mode should panic when no sequence is found", func() {
+				seqs := h.Sequence().NewSet(env)
+				So(seqs.NextByCode("test_sequence_unknown"), ShouldEqual, "False")
+				So(func() { seqs.WithContext("sequence_strict", true).NextByCode("test_sequence_unknown") }, ShouldPanic)
+				h.ConfigParameter().NewSet(env).SetParam("sequence.strict", "True")
+				So(func() { seqs.NextByCode("test_sequence_unknown") }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceNumberings(t *testing.T) {
+	Convey("Testing number encodings", t, func() {
+		So(EncodeNumber(35, SequenceNumberings["base36"], 3), ShouldEqual, "00Z")
+		So(EncodeNumber(26, SequenceNumberings["letters"], 0), ShouldEqual, "BA")
+		So(EncodeNumber(1, SequenceNumberings["letters"], 2), ShouldEqual, "AB")
+		So(EncodeNumber(1234, SequenceNumberings["crockford"], 0), ShouldEqual, "16J")
+		n, err := DecodeNumber("16j", SequenceNumberings["crockford"])
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1234)
+		n, err = DecodeNumber("L6J", SequenceNumberings["crockford"])
+		So(err, ShouldBeNil)
+		So(n, ShouldEqual, 1234)
+		_, err = DecodeNumber("1U", SequenceNumberings["crockford"])
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Testing sequences with numbering formats", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test numbering sequence").
+				SetImplementation("no_gap").
+				SetPrefix("T-").
+				SetPadding(3).
+				SetNumberNext(35).
+				SetNumbering("base36"))
+			Convey("Base 36 numbers should be padded", func() {
+				So(seq.NextN(2), ShouldResemble, []string{"T-00Z", "T-010"})
+			})
+			Convey("Letter numbers should be padded with A", func() {
+				seq.SetNumbering("letters")
+				So(seq.Next(), ShouldEqual, "T-ABJ")
+			})
+			Convey("Check digits should be computed over the encoded number", func() {
+				seq.SetNumbering("crockford")
+				seq.SetCheckDigit("luhn")
+				n := seq.Next()
+				So(n, ShouldEqual, "T-013"+LuhnCheckDigit("013"))
+				So(seq.ValidateNumber(n), ShouldBeTrue)
+			})
+			Convey("Check digits should be validated after alphabetic prefixes", func() {
+				seq.SetPrefix("INV")
+				seq.SetCheckDigit("luhn")
+				n := seq.Next()
+				So(n, ShouldEqual, "INV00Z"+LuhnCheckDigit("00Z"))
+				So(seq.ValidateNumber(n), ShouldBeTrue)
+				So(seq.ValidateNumber("INV00Z"+LuhnCheckDigit("INV00Z")), ShouldBeFalse)
+				So(seq.ValidateNumber("INV00Y"+LuhnCheckDigit("00Z")), ShouldBeFalse)
+			})
+			Convey("Audits should decode numbers", func() {
+				seq.SetNumbering("letters")
+				for _, ref := range []string{"T-ABJ", "T-ABL"} {
+					h.Partner().Create(env, h.Partner().NewData().SetName("Numbering "+ref).SetRef(ref))
+				}
+				lines := seq.Audit("Partner", "Ref").Filtered(func(r m.SequenceAuditLineSet) bool {
+					return r.Issue() == "missing"
+				})
+				So(lines.Len(), ShouldEqual, 1)
+				So(lines.Number(), ShouldEqual, 36)
+			})
+		}), ShouldBeNil)
+	})
+}
+
+func TestSequenceRepair(t *testing.T) {
+	Convey("Testing sequence repair", t, func() {
+		So(models.ExecuteInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			Convey("Create a standard sequence", func() {
+				seq := h.Sequence().Create(env, h.Sequence().NewData().
+					SetCode("test_sequence_type_9").
+					SetName("Test repair sequence"))
+				So(seq.IsEmpty(), ShouldBeFalse)
+			})
+			Convey("Repairing from the DB should update records", func() {
+				seq := h.Sequence().Search(env, q.Sequence().Code().Equals("test_sequence_type_9"))
+				So(seq.Next(), ShouldEqual, "1")
+				So(seq.Next(), ShouldEqual, "2")
+				So(seq.NumberNext(), ShouldEqual, 1)
+				So(seq.Repair("from_db"), ShouldEqual, 1)
+				So(seq.NumberNext(), ShouldEqual, 3)
+				So(seq.Repair("from_db"), ShouldEqual, 0)
+			})
+			Convey("Repairing to the DB should restart DB sequences", func() {
+				seq := h.Sequence().Search(env, q.Sequence().Code().Equals("test_sequence_type_9"))
+				env.Cr().Execute(`UPDATE sequence SET number_next = 10 WHERE id = ?`, seq.ID())
+				seq.Collection().InvalidateCache()
+				So(seq.Repair("to_db"), ShouldEqual, 1)
+				So(seq.Next(), ShouldEqual, "10")
+				So(func() { seq.Repair("sideways") }, ShouldPanic)
+			})
+		}), ShouldBeNil)
+	})
+	dropSequence("test_sequence_type_9")
+	Convey("Testing sequence states export and import", t, func() {
+		So(models.SimulateInNewEnvironment(security.SuperUserID, func(env models.Environment) {
+			seq := h.Sequence().Create(env, h.Sequence().NewData().
+				SetName("Test export sequence").
+				SetCode("test_sequence_export").
+				SetImplementation("no_gap").
+				SetUseDateRange(true))
+			date := dates.ParseDate("2019-03-15")
+			seq.WithContext("sequence_date", date).NextN(4)
+			seq.NextN(2)
+			export := seq.ExportStates()
+			So(export, ShouldContainSubstring, `"code": "test_sequence_export"`)
+			So(export, ShouldContainSubstring, `"date_from": "2019-01-01"`)
+			seq.DateRanges().Unlink()
+			seq.SetNumberNextActual(42)
+			So(h.Sequence().NewSet(env).ImportStates(export), ShouldEqual, 1)
+			So(seq.NumberNext(), ShouldEqual, 1)
+			So(seq.WithContext("sequence_date", date).Next(), ShouldEqual, "5")
+			So(func() { h.Sequence().NewSet(env).ImportStates("not json") }, ShouldPanic)
+		}), ShouldBeNil)
+	})
+}